@@ -0,0 +1,125 @@
+package main
+
+const (
+	CLIP_LOOP = iota
+	CLIP_ONCE
+	CLIP_PINGPONG
+)
+
+var clipModes = map[string]int{
+	"":         CLIP_LOOP,
+	"loop":     CLIP_LOOP,
+	"once":     CLIP_ONCE,
+	"pingpong": CLIP_PINGPONG,
+}
+
+// Clip is an animation from the atlas, every frame stays on screen for its
+// own duration. Looping clips start over after the last frame, one shot
+// clips stop on it and ping-pong clips play backwards back to the first.
+type Clip struct {
+	Frames []*Sprite
+	Mode   int
+}
+
+// Anim is the state of a clip playing on an entity. It only refers to the
+// clip by name so it can be copied and serialized along with the world.
+type Anim struct {
+	Clip    string
+	Frame   int
+	Timer   int
+	Reverse bool `json:",omitempty"`
+	Done    bool `json:",omitempty"`
+}
+
+func (a *Anim) Sprite() *Sprite {
+	c := atlas.Animation(a.Clip)
+	return c.Frames[a.Frame%len(c.Frames)]
+}
+
+// Update advances the animation by one frame. done is called when a one
+// shot clip finishes, or when a looping or ping-pong clip completes a cycle.
+func (a *Anim) Update(done func()) {
+	if a.Done {
+		return
+	}
+
+	c := atlas.Animation(a.Clip)
+	n := len(c.Frames)
+	if a.Timer++; a.Timer < c.Frames[a.Frame%n].Duration {
+		return
+	}
+	a.Timer = 0
+
+	cycled := false
+	switch c.Mode {
+	case CLIP_ONCE:
+		if a.Frame+1 < n {
+			a.Frame++
+		} else {
+			a.Done = true
+			cycled = true
+		}
+
+	case CLIP_PINGPONG:
+		switch {
+		case n == 1:
+			cycled = true
+		case !a.Reverse && a.Frame+1 >= n:
+			a.Reverse = true
+			a.Frame = n - 2
+		case a.Reverse && a.Frame <= 0:
+			a.Reverse = false
+			a.Frame = 1
+			cycled = true
+		case a.Reverse:
+			a.Frame--
+		default:
+			a.Frame++
+		}
+
+	default:
+		if a.Frame+1 < n {
+			a.Frame++
+		} else {
+			a.Frame = 0
+			cycled = true
+		}
+	}
+
+	if cycled && done != nil {
+		done()
+	}
+}
+
+// Animate advances the animations of everything in the world, it runs with
+// the update after the world has stepped rather than while drawing.
+func (w *World) Animate() {
+	for _, p := range w.Players {
+		if p.Flash > 0 {
+			p.Flash--
+		}
+		// switching to the invulnerable clip keeps the current frame so the
+		// ship does not jump back to the start of its animation
+		p.Anim.Clip = p.Skin
+		if p.Invuln {
+			p.Anim.Clip = p.Skin + "_invuln"
+		}
+		p.Anim.Update(nil)
+	}
+	for _, e := range w.Enemies {
+		if e.Alive {
+			e.Anim.Update(nil)
+		}
+	}
+	for _, e := range w.Explosions {
+		if e.Flash > 0 {
+			e.Flash--
+		}
+		if e.Alive {
+			e.Anim.Update(func() {
+				e.Alive = false
+			})
+		}
+	}
+	w.animateParticles()
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qeedquan/go-media/image/imageutil"
+	"github.com/qeedquan/go-media/sdl"
+	"github.com/qeedquan/go-media/sdl/sdlttf"
+)
+
+const MANIFEST = "manifest.json"
+
+// Manifest lists every asset the game loads, assets are referred to by name
+// and the manifest says which file holds them. A manifest.json in the assets
+// directory or pack replaces the built in one. Scoring and Versus replace
+// the built in scoring and versus rules when they are given.
+type Manifest struct {
+	Images  map[string]ImageAsset
+	Atlases []string `json:",omitempty"`
+	Fonts   map[string]FontAsset
+	Sounds  map[string]SoundAsset
+	Music   []string
+	Demos   []string `json:",omitempty"`
+
+	Emitters map[string]EmitterDef `json:",omitempty"`
+	Scoring  *Scoring              `json:",omitempty"`
+	Versus   *Versus               `json:",omitempty"`
+}
+
+// ImageAsset is an image along with the size it is expected to have, sprite
+// sheets also give the size of their frames. The sizes are used to check
+// the image and to draw a placeholder of the right size when it is missing.
+type ImageAsset struct {
+	File        string
+	Width       int
+	Height      int
+	FrameWidth  int `json:",omitempty"`
+	FrameHeight int `json:",omitempty"`
+}
+
+type FontAsset struct {
+	File string
+	Size int
+}
+
+type SoundAsset struct {
+	File      string
+	Group     string
+	Priority  string
+	Limit     int
+	Variation float64 `json:",omitempty"`
+}
+
+var (
+	soundGroups = map[string]int{
+		"weapons":    SFX_WEAPONS,
+		"explosions": SFX_EXPLOSIONS,
+	}
+	soundPriorities = map[string]int{
+		"low":    PRIORITY_LOW,
+		"normal": PRIORITY_NORMAL,
+		"high":   PRIORITY_HIGH,
+	}
+)
+
+func defaultManifest() Manifest {
+	return Manifest{
+		Images: map[string]ImageAsset{
+			"background":   {File: "background.png", Width: 640, Height: 640},
+			"title":        {File: "title.png", Width: 486, Height: 150},
+			"cursor":       {File: "menu_cursor.png", Width: 16, Height: 16},
+			"player":       {File: "player_ship.png", Width: 128, Height: 128, FrameWidth: 64, FrameHeight: 64},
+			"health_full":  {File: "health_full.png", Width: 16, Height: 24},
+			"health_empty": {File: "health_empty.png", Width: 16, Height: 24},
+			"laser":        {File: "laser.png", Width: 8, Height: 16},
+			"laser_enemy":  {File: "laser_enemy.png", Width: 8, Height: 16},
+			"enemy":        {File: "enemy_ship.png", Width: 128, Height: 32, FrameWidth: 64, FrameHeight: 32},
+			"enemy2":       {File: "enemy_ship2.png", Width: 128, Height: 64, FrameWidth: 64, FrameHeight: 64},
+			"explosion":    {File: "explosion.png", Width: 256, Height: 64, FrameWidth: 64, FrameHeight: 64},
+		},
+		Fonts: map[string]FontAsset{
+			"text": {File: "LCD_Solid.ttf", Size: 20},
+		},
+		Sounds: map[string]SoundAsset{
+			"player_fire": {File: "player_fire.wav", Group: "weapons", Priority: "normal", Limit: 4},
+			"enemy_fire":  {File: "enemy_fire.wav", Group: "weapons", Priority: "low", Limit: 6, Variation: 0.08},
+			"explosion":   {File: "explosion.wav", Group: "explosions", Priority: "high", Limit: 8, Variation: 0.05},
+		},
+		Music:    []string{"music1.ogg"},
+		Demos:    []string{"demo1.json", "demo2.json"},
+		Emitters: defaultEmitters(),
+	}
+}
+
+// AssetSource is where asset files are read from, either a directory or a
+// zip pack.
+type AssetSource interface {
+	ReadFile(name string) ([]byte, error)
+	String() string
+}
+
+type dirAssets string
+
+func (d dirAssets) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirAssets) String() string {
+	return string(d)
+}
+
+type zipAssets struct {
+	name  string
+	files map[string]*zip.File
+}
+
+func openZipAssets(name string) (*zipAssets, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	z := &zipAssets{
+		name:  name,
+		files: make(map[string]*zip.File),
+	}
+	for _, f := range r.File {
+		z.files[f.Name] = f
+	}
+	return z, nil
+}
+
+func (z *zipAssets) ReadFile(name string) ([]byte, error) {
+	f := z.files[path.Clean(name)]
+	if f == nil {
+		return nil, fmt.Errorf("%s: %s: file does not exist", z.name, name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (z *zipAssets) String() string {
+	return z.name
+}
+
+// openAssets opens the assets at name, a directory is read as is and a file
+// is read as a zip pack. When name does not exist a pack next to it with the
+// same name and a .zip extension is tried.
+func openAssets(name string) (AssetSource, error) {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		if _, zerr := os.Stat(name + ".zip"); zerr == nil {
+			return openZipAssets(name + ".zip")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return dirAssets(name), nil
+	}
+	return openZipAssets(name)
+}
+
+// AssetLoader loads the assets in a manifest. Problems do not stop loading,
+// they are collected so that every missing or broken asset can be reported
+// at once.
+type AssetLoader struct {
+	Source   AssetSource
+	Manifest Manifest
+	Errors   []error
+
+	// fatal is set by problems the game cannot run with unless placeholders
+	// are allowed, broken by problems it cannot run with at all
+	fatal  bool
+	broken bool
+
+	// SDL reads fonts lazily from memory, so the data has to stay around
+	keep [][]byte
+
+	images map[string]*Image
+}
+
+func openAssetLoader(name string) (*AssetLoader, error) {
+	src, err := openAssets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AssetLoader{
+		Source:   src,
+		Manifest: defaultManifest(),
+		images:   make(map[string]*Image),
+	}
+	buf, err := src.ReadFile(MANIFEST)
+	if err == nil {
+		var m Manifest
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, fmt.Errorf("%s: %v", MANIFEST, err)
+		}
+		l.Manifest = m
+	}
+	return l, nil
+}
+
+func (l *AssetLoader) errorf(fatal bool, format string, args ...interface{}) {
+	l.Errors = append(l.Errors, fmt.Errorf(format, args...))
+	if fatal {
+		l.fatal = true
+	}
+}
+
+// brokenf records a problem no placeholder can stand in for, such as a
+// missing font that all the text is drawn with.
+func (l *AssetLoader) brokenf(format string, args ...interface{}) {
+	l.errorf(true, format, args...)
+	l.broken = true
+}
+
+// Finish reports every problem found while loading, it fails when the game
+// cannot run without the assets that are missing.
+func (l *AssetLoader) Finish() {
+	for _, err := range l.Errors {
+		sdl.LogError(sdl.LOG_CATEGORY_APPLICATION, "%v", err)
+	}
+	if l.broken || (l.fatal && !conf.Placeholders) {
+		ck(l.Error())
+	}
+}
+
+func (l *AssetLoader) Error() error {
+	if len(l.Errors) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, err := range l.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// Image loads an image once, later calls return the same image.
+func (l *AssetLoader) Image(name string) *Image {
+	if m, ok := l.images[name]; ok {
+		return m
+	}
+	m := l.loadImage(name)
+	l.images[name] = m
+	return m
+}
+
+func (l *AssetLoader) loadImage(name string) *Image {
+	a, ok := l.Manifest.Images[name]
+	if !ok {
+		l.errorf(true, "image %q is not in the manifest", name)
+		return placeholderImage(a)
+	}
+
+	sdl.Log("loading image %v", a.File)
+	buf, err := l.Source.ReadFile(a.File)
+	if err != nil {
+		l.errorf(true, "image %q: %v", name, err)
+		return placeholderImage(a)
+	}
+	rgba, err := checkImage(a, buf)
+	if err != nil {
+		l.errorf(true, "image %q: %v", name, err)
+		return placeholderImage(a)
+	}
+	rgba = imageutil.ColorKey(rgba, color.RGBA{0xff, 0, 0xff, 0xff})
+	return &Image{
+		RGBA: rgba,
+	}
+}
+
+// AtlasFile reads the atlases listed in the manifest into one, the built in
+// atlas is used when the manifest lists none.
+func (l *AssetLoader) AtlasFile() AtlasFile {
+	if len(l.Manifest.Atlases) == 0 {
+		return defaultAtlas()
+	}
+
+	a := AtlasFile{
+		Frames:     make(map[string]AtlasFrame),
+		Animations: make(map[string]AtlasClip),
+	}
+	for _, file := range l.Manifest.Atlases {
+		var f AtlasFile
+		buf, err := l.Source.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(buf, &f)
+		}
+		if err != nil {
+			l.errorf(true, "atlas %q: %v", file, err)
+			continue
+		}
+		for name, frame := range f.Frames {
+			a.Frames[name] = frame
+		}
+		for name, frames := range f.Animations {
+			a.Animations[name] = frames
+		}
+	}
+	return a
+}
+
+// Atlas loads the atlas and the images its frames are cut from.
+func (l *AssetLoader) Atlas() *Atlas {
+	a := l.AtlasFile()
+	for _, err := range checkAtlas(a, l.Manifest.Images) {
+		l.errorf(true, "atlas: %v", err)
+	}
+	for _, f := range a.Frames {
+		l.Image(f.Image)
+	}
+	return newAtlas(a, l.images)
+}
+
+// Scoring returns the scoring and versus rules, the built in ones are used
+// for what the manifest does not give or gives broken.
+func (l *AssetLoader) Scoring() (Scoring, Versus) {
+	s, v := defaultScoring(), defaultVersus()
+	if m := l.Manifest.Scoring; m != nil {
+		if err := checkScoring(*m); err != nil {
+			l.errorf(false, "scoring: %v", err)
+		} else {
+			s = *m
+		}
+	}
+	if m := l.Manifest.Versus; m != nil {
+		if m.GarbageChain < 0 {
+			l.errorf(false, "versus: invalid garbage chain %d", m.GarbageChain)
+		} else {
+			v = *m
+		}
+	}
+	return s, v
+}
+
+// Emitters returns the particle emitters, the manifest can replace the
+// built in ones or add new ones. Broken emitters are left out.
+func (l *AssetLoader) Emitters() map[string]*EmitterDef {
+	defs := defaultEmitters()
+	for name, def := range l.Manifest.Emitters {
+		defs[name] = def
+	}
+
+	m := make(map[string]*EmitterDef)
+	for name, def := range defs {
+		if err := checkEmitter(def); err != nil {
+			l.errorf(false, "emitter %q: %v", name, err)
+			continue
+		}
+		def := def
+		m[name] = &def
+	}
+	return m
+}
+
+func (l *AssetLoader) Font(name string) *sdlttf.Font {
+	a, ok := l.Manifest.Fonts[name]
+	if !ok {
+		l.brokenf("font %q is not in the manifest", name)
+		return nil
+	}
+
+	sdl.Log("loading font %v", a.File)
+	buf, err := l.Source.ReadFile(a.File)
+	if err == nil {
+		err = checkFont(a, buf)
+	}
+	if err != nil {
+		l.brokenf("font %q: %v", name, err)
+		return nil
+	}
+
+	rw, err := sdl.RWFromMem(buf)
+	if err != nil {
+		l.brokenf("font %q: %v", name, err)
+		return nil
+	}
+	font, err := sdlttf.OpenFontRW(rw, true, a.Size)
+	if err != nil {
+		l.brokenf("font %q: %v", name, err)
+		return nil
+	}
+	l.keep = append(l.keep, buf)
+	return font
+}
+
+// Sound loads a sound effect, a pitch variation makes it play at a slightly
+// lower or higher pitch at random.
+func (l *AssetLoader) Sound(name string) *Sound {
+	a, ok := l.Manifest.Sounds[name]
+	if !ok {
+		l.errorf(false, "sound %q is not in the manifest", name)
+		return nil
+	}
+
+	sdl.Log("loading sound %v", a.File)
+	buf, err := l.Source.ReadFile(a.File)
+	if err == nil {
+		err = checkSound(a, buf)
+	}
+	if err != nil {
+		l.errorf(false, "sound %q: %v", name, err)
+		return nil
+	}
+
+	pitches := []float64{1}
+	if a.Variation > 0 {
+		pitches = append(pitches, 1-a.Variation, 1+a.Variation)
+	}
+	snd := &Sound{
+		Group:    soundGroups[a.Group],
+		Priority: soundPriorities[a.Priority],
+		Limit:    a.Limit,
+	}
+	for i, pitch := range pitches {
+		v := SoundVariant{Name: a.File}
+		if i > 0 {
+			v.Name = fmt.Sprintf("%s#%d", a.File, i)
+		}
+		wav := pitchWAV(buf, pitch)
+		if err := audio.LoadSound(v.Name, wav); err != nil {
+			l.errorf(false, "sound %q: %v", name, err)
+			continue
+		}
+		snd.Variants = append(snd.Variants, v)
+	}
+	return snd
+}
+
+func (l *AssetLoader) Music(name string) bool {
+	sdl.Log("loading music %v", name)
+	buf, err := l.Source.ReadFile(name)
+	if err == nil {
+		err = checkMusic(buf)
+	}
+	if err == nil {
+		err = audio.LoadMusic(name, buf)
+	}
+	if err != nil {
+		l.errorf(false, "music %q: %v", name, err)
+		return false
+	}
+	return true
+}
+
+// Demo loads a replay that is played on the title screen.
+func (l *AssetLoader) Demo(name string) *Replay {
+	sdl.Log("loading demo %v", name)
+	buf, err := l.Source.ReadFile(name)
+	var r *Replay
+	if err == nil {
+		r, err = decodeReplay(buf)
+	}
+	if err != nil {
+		l.errorf(false, "demo %q: %v", name, err)
+		return nil
+	}
+	return r
+}
+
+// Validate checks every asset in the manifest and every track the config
+// refers to without loading anything into SDL.
+func (l *AssetLoader) Validate() {
+	var names []string
+	for name := range l.Manifest.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := l.Manifest.Images[name]
+		buf, err := l.Source.ReadFile(a.File)
+		if err == nil {
+			_, err = checkImage(a, buf)
+		}
+		if err != nil {
+			l.errorf(true, "image %q: %v", name, err)
+		}
+	}
+
+	for _, err := range checkAtlas(l.AtlasFile(), l.Manifest.Images) {
+		l.errorf(true, "atlas: %v", err)
+	}
+
+	for i, v := range conf.Levels {
+		for _, b := range v.backgroundLayers() {
+			if _, ok := l.Manifest.Images[b.Image]; !ok {
+				l.errorf(true, "level %d: background image %q is not in the manifest", i+1, b.Image)
+			}
+		}
+	}
+
+	names = names[:0]
+	for name := range l.Manifest.Emitters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checkEmitter(l.Manifest.Emitters[name]); err != nil {
+			l.errorf(false, "emitter %q: %v", name, err)
+		}
+	}
+
+	l.Scoring()
+
+	names = names[:0]
+	for name := range l.Manifest.Fonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := l.Manifest.Fonts[name]
+		buf, err := l.Source.ReadFile(a.File)
+		if err == nil {
+			err = checkFont(a, buf)
+		}
+		if err != nil {
+			l.brokenf("font %q: %v", name, err)
+		}
+	}
+
+	names = names[:0]
+	for name := range l.Manifest.Sounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := l.Manifest.Sounds[name]
+		buf, err := l.Source.ReadFile(a.File)
+		if err == nil {
+			err = checkSound(a, buf)
+		}
+		if err != nil {
+			l.errorf(false, "sound %q: %v", name, err)
+		}
+	}
+
+	for _, name := range musicTracks(l.Manifest) {
+		buf, err := l.Source.ReadFile(name)
+		if err == nil {
+			err = checkMusic(buf)
+		}
+		if err != nil {
+			l.errorf(false, "music %q: %v", name, err)
+		}
+	}
+
+	for _, name := range l.Manifest.Demos {
+		buf, err := l.Source.ReadFile(name)
+		if err == nil {
+			_, err = decodeReplay(buf)
+		}
+		if err != nil {
+			l.errorf(false, "demo %q: %v", name, err)
+		}
+	}
+}
+
+// musicTracks returns the tracks in the manifest and the ones the levels and
+// soundtrack in the config refer to.
+func musicTracks(m Manifest) []string {
+	names := append([]string{}, m.Music...)
+	names = append(names, conf.Soundtrack.Boss, conf.Soundtrack.GameOver)
+	for _, l := range conf.Levels {
+		names = append(names, l.Music)
+	}
+
+	var tracks []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			tracks = append(tracks, name)
+		}
+	}
+	return tracks
+}
+
+func checkImage(a ImageAsset, buf []byte) (*image.RGBA, error) {
+	m, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	r := m.Bounds()
+	if (a.Width > 0 && r.Dx() != a.Width) || (a.Height > 0 && r.Dy() != a.Height) {
+		return nil, fmt.Errorf("image is %dx%d, expected %dx%d", r.Dx(), r.Dy(), a.Width, a.Height)
+	}
+	if (a.FrameWidth > 0 && r.Dx()%a.FrameWidth != 0) || (a.FrameHeight > 0 && r.Dy()%a.FrameHeight != 0) {
+		return nil, fmt.Errorf("image is %dx%d which does not fit %dx%d frames", r.Dx(), r.Dy(), a.FrameWidth, a.FrameHeight)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), m, r.Min, draw.Src)
+	return rgba, nil
+}
+
+func checkScoring(s Scoring) error {
+	switch {
+	case len(s.Enemies) == 0:
+		return errors.New("no enemy scores")
+	case s.ChainWindow < 0 || s.ChainStep < 1:
+		return fmt.Errorf("invalid chain window %d or step %d", s.ChainWindow, s.ChainStep)
+	case s.MaxMultiplier < 1:
+		return fmt.Errorf("invalid multiplier %d", s.MaxMultiplier)
+	case s.GrazeRadius < 0 || s.GrazeMeter < 0:
+		return fmt.Errorf("invalid graze radius %d or meter %d", s.GrazeRadius, s.GrazeMeter)
+	case s.BombEvery < 0 || s.BombDrop < 0 || s.BombDrop > 100:
+		return fmt.Errorf("invalid bomb score %d or drop chance %d", s.BombEvery, s.BombDrop)
+	}
+	return nil
+}
+
+func checkFont(a FontAsset, buf []byte) error {
+	if a.Size <= 0 {
+		return fmt.Errorf("invalid point size %d", a.Size)
+	}
+	if len(buf) < 4 {
+		return errors.New("not a font file")
+	}
+	switch string(buf[:4]) {
+	case "\x00\x01\x00\x00", "OTTO", "true", "ttcf":
+		return nil
+	}
+	return errors.New("not a font file")
+}
+
+func checkSound(a SoundAsset, buf []byte) error {
+	if _, ok := soundGroups[a.Group]; !ok {
+		return fmt.Errorf("unknown sound group %q", a.Group)
+	}
+	if _, ok := soundPriorities[a.Priority]; !ok {
+		return fmt.Errorf("unknown priority %q", a.Priority)
+	}
+	if off, size := wavFormat(buf); off < 0 || size == 0 {
+		return errors.New("not a WAV file")
+	}
+	return nil
+}
+
+func checkMusic(buf []byte) error {
+	if len(buf) == 0 {
+		return errors.New("file is empty")
+	}
+	return nil
+}
+
+// placeholderImage draws a checkerboard the size of the asset so missing art
+// still shows up where it belongs, with an outline around every frame of a
+// sprite sheet.
+func placeholderImage(a ImageAsset) *Image {
+	w, h := a.Width, a.Height
+	if w <= 0 || h <= 0 {
+		w, h = 32, 32
+	}
+	fw, fh := a.FrameWidth, a.FrameHeight
+	if fw <= 0 {
+		fw = w
+	}
+	if fh <= 0 {
+		fh = h
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{0x20, 0x20, 0x20, 0xff}
+			if (x/8+y/8)%2 == 0 {
+				c = color.RGBA{0xff, 0x40, 0xc0, 0xff}
+			}
+			if x%fw == 0 || y%fh == 0 || x%fw == fw-1 || y%fh == fh-1 {
+				c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return &Image{RGBA: m, Placeholder: true}
+}
+
+// validateAssets checks the assets without starting the game and prints
+// every problem found.
+func validateAssets() bool {
+	l, err := openAssetLoader(conf.Assets)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	l.Validate()
+	for _, err := range l.Errors {
+		fmt.Println(err)
+	}
+	if len(l.Errors) == 0 {
+		fmt.Printf("%v: all assets are valid\n", l.Source)
+	}
+	return len(l.Errors) == 0
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AtlasFile describes the sprites cut out of the images in the manifest.
+// Every frame names the image it comes from, its rectangle in that image,
+// the pivot it is drawn around and how many frames it stays on screen.
+// Animations list the names of their frames and how they play, either
+// "loop", "once" or "pingpong".
+type AtlasFile struct {
+	Frames     map[string]AtlasFrame
+	Animations map[string]AtlasClip
+}
+
+type AtlasClip struct {
+	Frames []string
+	Mode   string `json:",omitempty"`
+}
+
+type AtlasFrame struct {
+	Image    string
+	X, Y     int
+	W, H     int
+	PivotX   int `json:",omitempty"`
+	PivotY   int `json:",omitempty"`
+	Duration int `json:",omitempty"`
+}
+
+// Sprite is a frame of an atlas ready to be drawn.
+type Sprite struct {
+	*Image
+	Pivot    image.Point
+	Duration int
+
+	flash *Image
+}
+
+func (s *Sprite) Blit(x, y int) {
+	s.Image.Blit(x-s.Pivot.X, y-s.Pivot.Y)
+}
+
+// Atlas holds the animations entities refer to by name.
+type Atlas struct {
+	Animations map[string]*Clip
+}
+
+func defaultAtlas() AtlasFile {
+	a := AtlasFile{
+		Frames: map[string]AtlasFrame{
+			"player_0":        {Image: "player", X: 0, Y: 0, W: 64, H: 64, Duration: 3},
+			"player_1":        {Image: "player", X: 64, Y: 0, W: 64, H: 64, Duration: 3},
+			"player_invuln_1": {Image: "player", X: 64, Y: 64, W: 64, H: 64, Duration: 3},
+			"enemy_0":         {Image: "enemy", X: 0, Y: 0, W: 64, H: 32, Duration: 3},
+			"enemy_1":         {Image: "enemy", X: 64, Y: 0, W: 64, H: 32, Duration: 3},
+			"enemy2_0":        {Image: "enemy2", X: 0, Y: 0, W: 64, H: 64, Duration: 3},
+			"enemy2_1":        {Image: "enemy2", X: 64, Y: 0, W: 64, H: 64, Duration: 3},
+		},
+		Animations: map[string]AtlasClip{
+			"player":        {Frames: []string{"player_0", "player_1"}},
+			"player_invuln": {Frames: []string{"player_0", "player_invuln_1"}},
+			"enemy":         {Frames: []string{"enemy_0", "enemy_1"}},
+			"enemy2":        {Frames: []string{"enemy2_0", "enemy2_1"}},
+			"explosion": {
+				Frames: []string{"explosion_0", "explosion_1", "explosion_2", "explosion_3", "explosion_1", "explosion_2", "explosion_3", "explosion_3"},
+				Mode:   "once",
+			},
+		},
+	}
+	for i := 0; i < 4; i++ {
+		a.Frames[fmt.Sprintf("explosion_%d", i)] = AtlasFrame{Image: "explosion", X: i * 64, Y: 0, W: 64, H: 64, Duration: 1}
+	}
+	return a
+}
+
+// checkAtlas makes sure every frame lies within its image and every
+// animation only uses frames that exist.
+func checkAtlas(a AtlasFile, images map[string]ImageAsset) []error {
+	var errs []error
+
+	var names []string
+	for name := range a.Frames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := a.Frames[name]
+		m, ok := images[f.Image]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("frame %q: image %q is not in the manifest", name, f.Image))
+		case f.W <= 0 || f.H <= 0 || f.X < 0 || f.Y < 0 || f.X+f.W > m.Width || f.Y+f.H > m.Height:
+			errs = append(errs, fmt.Errorf("frame %q: %dx%d+%d+%d is outside of image %q", name, f.W, f.H, f.X, f.Y, f.Image))
+		}
+	}
+
+	names = names[:0]
+	for name := range a.Animations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := a.Animations[name]
+		if len(c.Frames) == 0 {
+			errs = append(errs, fmt.Errorf("animation %q has no frames", name))
+		}
+		if _, ok := clipModes[c.Mode]; !ok {
+			errs = append(errs, fmt.Errorf("animation %q: unknown mode %q", name, c.Mode))
+		}
+		for _, f := range c.Frames {
+			if _, ok := a.Frames[f]; !ok {
+				errs = append(errs, fmt.Errorf("animation %q: frame %q does not exist", name, f))
+			}
+		}
+	}
+	return errs
+}
+
+// newAtlas cuts the sprites of the atlas out of the images.
+func newAtlas(a AtlasFile, images map[string]*Image) *Atlas {
+	sprites := make(map[string]*Sprite)
+	for name, f := range a.Frames {
+		duration := f.Duration
+		if duration <= 0 {
+			duration = 1
+		}
+		sprites[name] = &Sprite{
+			Image:    subImage(images[f.Image], f.X, f.Y, f.W, f.H),
+			Pivot:    image.Pt(f.PivotX, f.PivotY),
+			Duration: duration,
+		}
+	}
+
+	t := &Atlas{Animations: make(map[string]*Clip)}
+	for name, ac := range a.Animations {
+		c := &Clip{Mode: clipModes[ac.Mode]}
+		for _, f := range ac.Frames {
+			if s := sprites[f]; s != nil {
+				c.Frames = append(c.Frames, s)
+			}
+		}
+		if len(c.Frames) > 0 {
+			t.Animations[name] = c
+		}
+	}
+	return t
+}
+
+// Animation returns a clip by name, a missing clip is drawn with a
+// placeholder.
+func (t *Atlas) Animation(name string) *Clip {
+	if c := t.Animations[name]; c != nil {
+		return c
+	}
+	c := &Clip{Frames: []*Sprite{{Image: placeholderImage(ImageAsset{}), Duration: 1}}}
+	t.Animations[name] = c
+	return c
+}
+
+// Tint adds a copy of a clip with its colors multiplied by col.
+func (t *Atlas) Tint(name, from string, col color.RGBA) {
+	src := t.Animation(from)
+	c := &Clip{Mode: src.Mode}
+	for _, s := range src.Frames {
+		m := *s
+		m.Image = tintImage(s.Image, col)
+		m.flash = nil
+		c.Frames = append(c.Frames, &m)
+	}
+	t.Animations[name] = c
+}
+
+var atlasFrameNumber = regexp.MustCompile(`^(.+)[_-](\d+)$`)
+
+// runPackAtlas packs loose PNGs into one image and writes the atlas that
+// describes it. Every PNG becomes a frame named after the file, or is split
+// into numbered frames when a frame size is given, and frames named with a
+// number at the end are grouped into an animation in numeric order.
+func runPackAtlas(args []string) {
+	fs := flag.NewFlagSet("pack-atlas", flag.ExitOnError)
+	out := fs.String("o", "atlas", "output name, writes name.png and name.json")
+	size := fs.Int("size", 1024, "width of the packed image")
+	frame := fs.String("frame", "", "split every image into frames of this size, as WxH")
+	pad := fs.Int("pad", 1, "padding between frames")
+	duration := fs.Int("duration", 3, "duration of every frame")
+	fs.Parse(args)
+
+	var fw, fh int
+	if *frame != "" {
+		_, err := fmt.Sscanf(*frame, "%dx%d", &fw, &fh)
+		if err != nil || fw <= 0 || fh <= 0 {
+			fmt.Fprintf(os.Stderr, "pack-atlas: invalid frame size %q\n", *frame)
+			os.Exit(2)
+		}
+	}
+
+	type piece struct {
+		name string
+		m    *image.RGBA
+		r    image.Rectangle
+	}
+	var pieces []piece
+	for _, file := range fs.Args() {
+		m, err := loadPNG(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pack-atlas: %v\n", err)
+			os.Exit(1)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		b := m.Bounds()
+		if fw == 0 {
+			pieces = append(pieces, piece{name, m, b})
+			continue
+		}
+		n := 0
+		for y := b.Min.Y; y+fh <= b.Max.Y; y += fh {
+			for x := b.Min.X; x+fw <= b.Max.X; x += fw {
+				pieces = append(pieces, piece{fmt.Sprintf("%s_%d", name, n), m, image.Rect(x, y, x+fw, y+fh)})
+				n++
+			}
+		}
+	}
+
+	// shelf packing, tallest pieces first
+	sort.SliceStable(pieces, func(i, j int) bool {
+		return pieces[i].r.Dy() > pieces[j].r.Dy()
+	})
+	a := AtlasFile{
+		Frames:     make(map[string]AtlasFrame),
+		Animations: make(map[string]AtlasClip),
+	}
+	x, y, shelf, width := 0, 0, 0, 0
+	for _, p := range pieces {
+		w, h := p.r.Dx(), p.r.Dy()
+		if w > *size {
+			fmt.Fprintf(os.Stderr, "pack-atlas: %v is wider than the atlas\n", p.name)
+			os.Exit(1)
+		}
+		if x+w > *size {
+			x, y, shelf = 0, y+shelf+*pad, 0
+		}
+		a.Frames[p.name] = AtlasFrame{Image: filepath.Base(*out), X: x, Y: y, W: w, H: h, Duration: *duration}
+		if x+w > width {
+			width = x + w
+		}
+		if h > shelf {
+			shelf = h
+		}
+		x += w + *pad
+	}
+	height := y + shelf
+
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.RGBA{0xff, 0, 0xff, 0xff}), image.ZP, draw.Src)
+	for _, p := range pieces {
+		f := a.Frames[p.name]
+		draw.Draw(m, image.Rect(f.X, f.Y, f.X+f.W, f.Y+f.H), p.m, p.r.Min, draw.Src)
+	}
+
+	var names []string
+	for name := range a.Frames {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		bi, ni := atlasFrameIndex(names[i])
+		bj, nj := atlasFrameIndex(names[j])
+		if bi != bj {
+			return bi < bj
+		}
+		return ni < nj
+	})
+	for _, name := range names {
+		base, _ := atlasFrameIndex(name)
+		c := a.Animations[base]
+		c.Frames = append(c.Frames, name)
+		a.Animations[base] = c
+	}
+
+	err := savePNG(*out+".png", m)
+	if err == nil {
+		var buf []byte
+		buf, err = json.MarshalIndent(a, "", "\t")
+		if err == nil {
+			err = ioutil.WriteFile(*out+".json", buf, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pack-atlas: %v\n", err)
+		os.Exit(1)
+	}
+	name := filepath.Base(*out)
+	fmt.Printf("packed %d frames into %dx%d %v.png\n", len(pieces), width, height, *out)
+	fmt.Printf("to use it add %q: {\"File\": \"%s.png\", \"Width\": %d, \"Height\": %d} to Images and \"%s.json\" to Atlases in %s\n",
+		name, name, width, height, name, MANIFEST)
+}
+
+func atlasFrameIndex(name string) (string, int) {
+	m := atlasFrameNumber.FindStringSubmatch(name)
+	if m == nil {
+		return name, 0
+	}
+	n, _ := strconv.Atoi(m[2])
+	return m[1], n
+}
+
+func loadPNG(name string) (*image.RGBA, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	rgba := image.NewRGBA(m.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), m, m.Bounds().Min, draw.Src)
+	return rgba, nil
+}
+
+func savePNG(name string, m image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, m)
+	xerr := f.Close()
+	if err == nil {
+		err = xerr
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+// MAX_DEMOS is how many of the latest replays in the pref directory are
+// played as demos.
+const MAX_DEMOS = 5
+
+// Attract plays demos when the title screen has been left alone for a
+// while, like an arcade cabinet does. The demos are the replays listed in
+// the manifest, the game comes with two, and the latest games saved in the
+// pref directory, they take turns and any key or button goes back to the
+// menu.
+type Attract struct {
+	Demos  []*Replay
+	Player *ReplayPlayer
+	idle   int
+	next   int
+	frame  int
+}
+
+// Reset starts counting how long the title screen has been idle over.
+func (a *Attract) Reset() {
+	a.idle = 0
+}
+
+func (a *Attract) Update() {
+	if state == DEMO {
+		a.step()
+		return
+	}
+
+	a.idle++
+	if console.Open {
+		a.idle = 0
+	}
+	if n := conf.Attract.Idle; n > 0 && a.idle >= n*FPS && len(a.Demos) > 0 {
+		a.Start()
+	}
+}
+
+// Start plays the next demo.
+func (a *Attract) Start() {
+	r := a.Demos[a.next%len(a.Demos)]
+	a.next++
+	a.Reset()
+
+	p, err := newReplayPlayer(r)
+	if ek(err) {
+		return
+	}
+	a.Player = p
+	a.frame = 0
+	state = DEMO
+	startWorlds(p.Worlds)
+}
+
+// Stop goes back to the title screen.
+func (a *Attract) Stop() {
+	a.Player = nil
+	a.Reset()
+	state = TITLE
+	startWorlds(nil)
+	setScreenSize(WIDTH, HEIGHT)
+}
+
+func (a *Attract) step() {
+	held := holdWorlds()
+	if !held && (!a.Player.Step() || gameOver()) {
+		if a.Player.Err != nil {
+			sdl.Log("demo: %v", a.Player.Err)
+		}
+		a.Stop()
+		return
+	}
+	if atlas != nil {
+		for _, w := range worlds {
+			if !held {
+				w.Animate()
+			}
+			w.animateCamera()
+		}
+	}
+	a.frame++
+}
+
+// Blit draws the banner over the demo, it blinks once a second.
+func (a *Attract) Blit() {
+	if a.frame%FPS >= FPS/2 {
+		return
+	}
+	text := "PRESS START"
+	blitText((canvas.Bounds().Dx()-len(text)*12)/2, 200, text)
+}
+
+// pressed reports whether an event is a key or button being pressed.
+func pressed(ev sdl.Event) bool {
+	switch ev.(type) {
+	case sdl.KeyDownEvent, sdl.ControllerButtonDownEvent:
+		return true
+	}
+	return false
+}
+
+// loadDemos loads the demos in the manifest and the latest replays saved in
+// the pref directory, demos that do not load are left out.
+func loadDemos(l *AssetLoader) []*Replay {
+	var demos []*Replay
+	for _, name := range l.Manifest.Demos {
+		if r := l.Demo(name); r != nil {
+			demos = append(demos, r)
+		}
+	}
+	return append(demos, recentReplays(MAX_DEMOS)...)
+}
+
+// recentReplays loads the last n replays saved in the pref directory newest
+// first, their names start with the time they were saved so they sort in
+// the order they were played.
+func recentReplays(n int) []*Replay {
+	names, err := filepath.Glob(filepath.Join(conf.Pref, "replays", "espada-*.json"))
+	if ek(err) {
+		return nil
+	}
+	sort.Strings(names)
+	if len(names) > n {
+		names = names[len(names)-n:]
+	}
+
+	var replays []*Replay
+	for i := len(names) - 1; i >= 0; i-- {
+		sdl.Log("loading demo %v", names[i])
+		r, err := loadReplay(names[i])
+		if ek(err) {
+			continue
+		}
+		replays = append(replays, r)
+	}
+	return replays
+}
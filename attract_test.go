@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundledDemos(t *testing.T) {
+	conf.Defaults()
+	defer func() { silent = false }()
+	silent = true
+
+	for _, name := range defaultManifest().Demos {
+		buf, err := ioutil.ReadFile(filepath.Join("assets", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decodeReplay(buf)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if err := checkRules(r.Rules, conf.Rules()); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+
+		p, err := newReplayPlayer(r)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		for p.Step() {
+		}
+		if p.Err != nil {
+			t.Errorf("%v: %v", name, p.Err)
+		}
+		if p.Frame != len(r.Frames) {
+			t.Errorf("%v: stopped on frame %d of %d", name, p.Frame, len(r.Frames))
+		}
+	}
+}
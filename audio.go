@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	MAX_CHANNELS = 128
+
+	// how much quieter a sound at the top of the screen is than one at the
+	// bottom where the players are
+	ATTENUATION = 0.5
+)
+
+const (
+	SFX_WEAPONS = iota
+	SFX_EXPLOSIONS
+)
+
+const (
+	PRIORITY_LOW = iota
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+// Sound is a sound effect along with the rules for mixing it with the
+// other sounds playing at the same time. Sounds that play often can have
+// variants at slightly different pitches, one is picked at random every time
+// it plays so that it does not sound as repetitive.
+type Sound struct {
+	Variants []SoundVariant
+	Group    int
+	Priority int
+	Limit    int
+}
+
+// SoundVariant is one pitch of a sound as loaded into the audio backend,
+// the variants after the first are named after the sound with a #n suffix.
+type SoundVariant struct {
+	Name string
+}
+
+// soundName returns the name of the sound a variant belongs to.
+func soundName(variant string) string {
+	if i := strings.LastIndex(variant, "#"); i >= 0 {
+		return variant[:i]
+	}
+	return variant
+}
+
+// Mixer hands out the mixer channels to sound effects. It asks the audio
+// backend which channels are still playing so that a new sound goes on a
+// free channel, and when there are none it takes over one playing a sound
+// that is less important.
+type Mixer struct {
+	channels []mixerChannel
+	plays    int
+}
+
+// mixerChannel is the sound last played on a channel, start counts the
+// sounds played before it so the oldest one can be found.
+type mixerChannel struct {
+	sound *Sound
+	start int
+}
+
+func (m *Mixer) Init(channels int) {
+	m.channels = make([]mixerChannel, channels)
+}
+
+// Play plays a sound panned and attenuated for an emitter at x, y on the
+// screen.
+func (m *Mixer) Play(snd *Sound, x, y int) {
+	if snd == nil || len(snd.Variants) == 0 || !conf.Sound || silent {
+		return
+	}
+
+	ch := m.allocate(snd)
+	if ch < 0 {
+		return
+	}
+
+	v := snd.Variants[rand.Intn(len(snd.Variants))]
+	left, right := panning(x, y)
+	err := audio.PlaySound(v.Name, ch, groupVolume(snd.Group), left, right)
+	if ek(err) {
+		return
+	}
+	m.channels[ch] = mixerChannel{
+		sound: snd,
+		start: m.plays,
+	}
+	m.plays++
+}
+
+// allocate returns the channel a sound should play on or -1 if it should be
+// dropped. A sound that already plays as many times as it is allowed to
+// restarts its oldest instance, and of the sounds as important as it the
+// oldest is the one taken over since it is the closest to finishing.
+func (m *Mixer) allocate(snd *Sound) int {
+	free, oldest, victim := -1, -1, -1
+	instances := 0
+	for i, c := range m.channels {
+		if c.sound == nil || !audio.Playing(i) {
+			if free < 0 {
+				free = i
+			}
+			continue
+		}
+
+		if c.sound == snd {
+			instances++
+			if oldest < 0 || c.start < m.channels[oldest].start {
+				oldest = i
+			}
+		}
+
+		if c.sound.Priority > snd.Priority {
+			continue
+		}
+		if victim < 0 {
+			victim = i
+			continue
+		}
+		v := m.channels[victim]
+		if c.sound.Priority < v.sound.Priority || (c.sound.Priority == v.sound.Priority && c.start < v.start) {
+			victim = i
+		}
+	}
+
+	switch {
+	case snd.Limit > 0 && instances >= snd.Limit:
+		return oldest
+	case free >= 0:
+		return free
+	default:
+		return victim
+	}
+}
+
+// panning returns the left and right volumes for an emitter, it is panned
+// with constant power by its x position and gets quieter the further up the
+// screen it is.
+func panning(x, y int) (left, right uint8) {
+	a := float64(clamp(x, 0, WIDTH)) / WIDTH * math.Pi / 2
+	g := 1 - ATTENUATION*float64(BOTTOM-clamp(y, 0, BOTTOM))/BOTTOM
+	return uint8(255 * g * math.Cos(a)), uint8(255 * g * math.Sin(a))
+}
+
+// groupVolume is the channel volume for a sound group, the group volumes
+// scale the overall sound effect volume.
+func groupVolume(group int) int {
+	v := conf.Volume.Sound * 10
+	switch group {
+	case SFX_WEAPONS:
+		v = v * conf.Volume.Weapons / 12
+	case SFX_EXPLOSIONS:
+		v = v * conf.Volume.Explosions / 12
+	}
+	return v
+}
+
+// wavFormat finds the offset of the format chunk and the size of the sample
+// data of a WAV file, the offset is -1 if the file is not a WAV file.
+func wavFormat(buf []byte) (off int, size uint32) {
+	off = -1
+	if len(buf) < 12 || string(buf[0:4]) != "RIFF" || string(buf[8:12]) != "WAVE" {
+		return
+	}
+	for p := 12; p+8 <= len(buf); {
+		id := string(buf[p : p+4])
+		n := binary.LittleEndian.Uint32(buf[p+4:])
+		p += 8
+		switch id {
+		case "fmt ":
+			if p+16 <= len(buf) {
+				off = p
+			}
+		case "data":
+			size = n
+		}
+		p += int(n) + int(n&1)
+	}
+	return
+}
+
+// wavFrames reads how many frames a WAV file plays for from its header, the
+// recording backend plays nothing so it uses this to know when a channel is
+// free again.
+func wavFrames(buf []byte) int {
+	f, size := wavFormat(buf)
+	if f < 0 {
+		return 0
+	}
+	bytesPerSec := int64(binary.LittleEndian.Uint32(buf[f+8:]))
+	if bytesPerSec == 0 {
+		return 0
+	}
+	return int((int64(size)*FPS + bytesPerSec - 1) / bytesPerSec)
+}
+
+// pitchWAV returns a copy of a WAV file that claims a different sample rate,
+// the mixer resamples it to the output rate when it is loaded which changes
+// the pitch by the given factor.
+func pitchWAV(buf []byte, pitch float64) []byte {
+	f, _ := wavFormat(buf)
+	if f < 0 {
+		return buf
+	}
+	b := append([]byte(nil), buf...)
+	rate := binary.LittleEndian.Uint32(b[f+4:])
+	bytesPerSec := binary.LittleEndian.Uint32(b[f+8:])
+	binary.LittleEndian.PutUint32(b[f+4:], uint32(float64(rate)*pitch))
+	binary.LittleEndian.PutUint32(b[f+8:], uint32(float64(bytesPerSec)*pitch))
+	return b
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/qeedquan/go-media/sdl"
+	"github.com/qeedquan/go-media/sdl/sdlmixer"
+)
+
+// Audio is the device sounds and music are played on. Sounds and music are
+// loaded under a name and played by that name, so the game never holds on
+// to anything that belongs to a particular backend.
+type Audio interface {
+	Open(channels int) error
+	LoadSound(name string, wav []byte) error
+	LoadMusic(name string, data []byte) error
+	PlaySound(name string, channel, volume int, left, right uint8) error
+	Playing(channel int) bool
+	PlayMusic(name string, loops, fade int)
+	StopMusic(fade int)
+	MusicVolume(volume int)
+}
+
+// newAudio creates the backend named by the -audio flag, the recording
+// backend logs every sound as it plays.
+func newAudio(name string) Audio {
+	switch name {
+	case "null":
+		return nullAudio{}
+	case "record":
+		a := newRecordingAudio(audioFrame)
+		a.Log = true
+		return a
+	}
+	return newSDLAudio()
+}
+
+// audioFrame is the frame the recording backend logs sounds under.
+func audioFrame() int {
+	if len(worlds) == 0 {
+		return 0
+	}
+	return worlds[0].Frame
+}
+
+type sdlAudio struct {
+	chunks map[string]*sdlmixer.Chunk
+	music  map[string]*sdlmixer.Music
+
+	// music is streamed from memory, so the data has to stay around
+	data map[string][]byte
+}
+
+func newSDLAudio() *sdlAudio {
+	return &sdlAudio{
+		chunks: make(map[string]*sdlmixer.Chunk),
+		music:  make(map[string]*sdlmixer.Music),
+		data:   make(map[string][]byte),
+	}
+}
+
+func (a *sdlAudio) Open(channels int) error {
+	err := sdl.InitSubSystem(sdl.INIT_AUDIO)
+	if err != nil {
+		return err
+	}
+
+	err = sdlmixer.OpenAudio(44100, sdl.AUDIO_S16, 2, 8192)
+	if err != nil {
+		return err
+	}
+
+	_, err = sdlmixer.Init(sdlmixer.INIT_OGG)
+	ek(err)
+
+	sdlmixer.AllocateChannels(channels)
+	return nil
+}
+
+func (a *sdlAudio) LoadSound(name string, wav []byte) error {
+	rw, err := sdl.RWFromMem(wav)
+	if err != nil {
+		return err
+	}
+	chunk, err := sdlmixer.LoadWAVRW(rw, true)
+	if err != nil {
+		return err
+	}
+	a.chunks[name] = chunk
+	return nil
+}
+
+func (a *sdlAudio) LoadMusic(name string, data []byte) error {
+	rw, err := sdl.RWFromMem(data)
+	if err != nil {
+		return err
+	}
+	mus, err := sdlmixer.LoadMUSRW(rw, true)
+	if err != nil {
+		return err
+	}
+	a.music[name] = mus
+	a.data[name] = data
+	return nil
+}
+
+func (a *sdlAudio) PlaySound(name string, channel, volume int, left, right uint8) error {
+	chunk := a.chunks[name]
+	if chunk == nil {
+		return fmt.Errorf("sound %q is not loaded", name)
+	}
+	sdlmixer.Volume(channel, volume)
+	sdlmixer.SetPanning(channel, left, right)
+	_, err := chunk.PlayChannel(channel, 0)
+	return err
+}
+
+func (a *sdlAudio) Playing(channel int) bool {
+	return sdlmixer.Playing(channel) != 0
+}
+
+func (a *sdlAudio) PlayMusic(name string, loops, fade int) {
+	if mus := a.music[name]; mus != nil {
+		sdlmixer.FadeInMusic(mus, loops, fade)
+	}
+}
+
+func (a *sdlAudio) StopMusic(fade int) {
+	sdlmixer.FadeOutMusic(fade)
+}
+
+func (a *sdlAudio) MusicVolume(volume int) {
+	sdlmixer.VolumeMusic(volume)
+}
+
+// nullAudio accepts everything and plays nothing, it is used when there is
+// no audio device such as in headless runs.
+type nullAudio struct{}
+
+func (nullAudio) Open(int) error                                 { return nil }
+func (nullAudio) LoadSound(string, []byte) error                 { return nil }
+func (nullAudio) LoadMusic(string, []byte) error                 { return nil }
+func (nullAudio) PlaySound(string, int, int, uint8, uint8) error { return nil }
+func (nullAudio) Playing(int) bool                               { return false }
+func (nullAudio) PlayMusic(string, int, int)                     {}
+func (nullAudio) StopMusic(int)                                  {}
+func (nullAudio) MusicVolume(int)                                {}
+
+// AudioEvent is something the recording backend was asked to play.
+type AudioEvent struct {
+	Frame   int
+	Name    string
+	Channel int
+	Volume  int
+	Left    uint8
+	Right   uint8
+	Music   bool
+}
+
+func (e AudioEvent) String() string {
+	if e.Music {
+		if e.Name == "" {
+			return fmt.Sprintf("frame %d: music stopped", e.Frame)
+		}
+		return fmt.Sprintf("frame %d: music %v", e.Frame, e.Name)
+	}
+	return fmt.Sprintf("frame %d: sound %v on channel %d", e.Frame, e.Name, e.Channel)
+}
+
+// recordingAudio plays nothing but keeps a log of which sounds and music
+// played on which frame, so a run can be checked for the sounds it made.
+// Time is counted in frames of the game rather than on the wall clock, a
+// channel plays for as many frames as its sound lasts, so the same run makes
+// the same log every time.
+type recordingAudio struct {
+	nullAudio
+	Frame  func() int
+	Log    bool
+	mu     sync.Mutex
+	events []AudioEvent
+	length map[string]int
+	end    map[int]int
+}
+
+func newRecordingAudio(frame func() int) *recordingAudio {
+	return &recordingAudio{
+		Frame:  frame,
+		length: make(map[string]int),
+		end:    make(map[int]int),
+	}
+}
+
+func (a *recordingAudio) frame() int {
+	if a.Frame == nil {
+		return 0
+	}
+	return a.Frame()
+}
+
+func (a *recordingAudio) record(e AudioEvent) {
+	e.Frame = a.frame()
+	if a.Log {
+		sdl.Log("audio: %v", e)
+	}
+	a.mu.Lock()
+	a.events = append(a.events, e)
+	a.mu.Unlock()
+}
+
+func (a *recordingAudio) LoadSound(name string, wav []byte) error {
+	a.mu.Lock()
+	a.length[name] = wavFrames(wav)
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *recordingAudio) PlaySound(name string, channel, volume int, left, right uint8) error {
+	a.record(AudioEvent{Name: name, Channel: channel, Volume: volume, Left: left, Right: right})
+	a.mu.Lock()
+	a.end[channel] = a.frame() + a.length[name]
+	a.mu.Unlock()
+	return nil
+}
+
+// Playing reports whether the sound last played on the channel lasts past
+// the current frame.
+func (a *recordingAudio) Playing(channel int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.frame() < a.end[channel]
+}
+
+func (a *recordingAudio) PlayMusic(name string, loops, fade int) {
+	a.record(AudioEvent{Name: name, Music: true})
+}
+
+func (a *recordingAudio) StopMusic(fade int) {
+	a.record(AudioEvent{Music: true})
+}
+
+// Events returns the events recorded so far.
+func (a *recordingAudio) Events() []AudioEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AudioEvent(nil), a.events...)
+}
+
+// Played reports whether a variant of the sound played on the frame.
+func (a *recordingAudio) Played(sound string, frame int) bool {
+	for _, e := range a.Events() {
+		if !e.Music && e.Frame == frame && soundName(e.Name) == sound {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testWAV makes a silent 8 bit mono WAV file that plays for the given number
+// of frames.
+func testWAV(frames int) []byte {
+	const rate = 8000
+	size := rate * frames / FPS
+	buf := make([]byte, 44+size)
+	copy(buf[0:], "RIFF")
+	binary.LittleEndian.PutUint32(buf[4:], uint32(36+size))
+	copy(buf[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(buf[16:], 16)
+	binary.LittleEndian.PutUint16(buf[20:], 1)
+	binary.LittleEndian.PutUint16(buf[22:], 1)
+	binary.LittleEndian.PutUint32(buf[24:], rate)
+	binary.LittleEndian.PutUint32(buf[28:], rate)
+	binary.LittleEndian.PutUint16(buf[32:], 1)
+	binary.LittleEndian.PutUint16(buf[34:], 8)
+	copy(buf[36:], "data")
+	binary.LittleEndian.PutUint32(buf[40:], uint32(size))
+	for i := 44; i < len(buf); i++ {
+		buf[i] = 128
+	}
+	return buf
+}
+
+func TestRecordingAudioExplosion(t *testing.T) {
+	conf.Defaults()
+	conf.Invincible = true
+	defer func() { conf.Invincible = false }()
+
+	w := newWorld(MODE_COOP, 7, []int{0}, []int{0})
+	rec := newRecordingAudio(func() int { return w.Frame })
+	defer func(a Audio, s1, s2, s3 *Sound) {
+		audio = a
+		sfx.fire.player, sfx.fire.enemy, sfx.explosion = s1, s2, s3
+	}(audio, sfx.fire.player, sfx.fire.enemy, sfx.explosion)
+	audio = rec
+	mixer.Init(MAX_CHANNELS)
+
+	load := func(name string, frames, group, priority int) *Sound {
+		if err := rec.LoadSound(name, testWAV(frames)); err != nil {
+			t.Fatal(err)
+		}
+		return &Sound{Variants: []SoundVariant{{Name: name}}, Group: group, Priority: priority}
+	}
+	sfx.fire.player = load("player_fire.wav", 10, SFX_WEAPONS, PRIORITY_LOW)
+	sfx.fire.enemy = load("enemy_fire.wav", 10, SFX_WEAPONS, PRIORITY_LOW)
+	sfx.explosion = load("explosion.wav", 30, SFX_EXPLOSIONS, PRIORITY_HIGH)
+
+	p := w.Players[0]
+	kill := -1
+	for i := 0; i < 60*FPS && kill < 0; i++ {
+		// sweep across the screen firing all the time
+		input := uint64(KDZ | KDL)
+		if i/(2*FPS)%2 == 1 {
+			input = KDZ | KDR
+		}
+		chain := p.Chain
+		w.Step([]uint64{input})
+		if p.Chain > chain {
+			kill = w.Frame
+		}
+	}
+	if kill < 0 {
+		t.Fatal("no enemy was killed")
+	}
+
+	if !rec.Played("explosion.wav", kill) {
+		t.Errorf("no explosion played on frame %d: %v", kill, rec.Events())
+	}
+	for _, e := range rec.Events() {
+		if e.Name == "explosion.wav" && e.Frame != kill {
+			t.Errorf("explosion played on frame %d, the enemy died on frame %d", e.Frame, kill)
+		}
+	}
+
+	// the explosion keeps its channel for as long as it lasts
+	var ch int
+	for _, e := range rec.Events() {
+		if e.Name == "explosion.wav" {
+			ch = e.Channel
+		}
+	}
+	if !rec.Playing(ch) {
+		t.Errorf("channel %d is free on the frame its explosion started", ch)
+	}
+	for w.Frame < kill+30 {
+		w.Step([]uint64{0})
+	}
+	if rec.Playing(ch) {
+		t.Errorf("channel %d still plays %d frames after its explosion started", ch, w.Frame-kill)
+	}
+}
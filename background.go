@@ -0,0 +1,179 @@
+package main
+
+import "math"
+
+// Layer is one layer of a level's background, layers are drawn in order so
+// the furthest one comes first. Speed is how many pixels the layer scrolls
+// down every frame, images narrower than the screen are repeated across it
+// when Tile is set and drawn once at X otherwise.
+type Layer struct {
+	Image string
+	Speed float64
+	X     int  `json:",omitempty"`
+	Tile  bool `json:",omitempty"`
+}
+
+var defaultLayers = []Layer{
+	{Image: "background", Speed: 10},
+}
+
+// fallbackStars is the starfield drawn instead of background images that
+// did not load, it is seeded from the game like any other.
+var fallbackStars = &Starfield{Layers: 3, Stars: 60, Speed: 6, Twinkle: 0.5}
+
+// Parallax scrolls the background of the level being played, a generated
+// starfield behind its layers. Layers whose image did not load are left
+// out, and unless the level has a starfield of its own one is drawn
+// instead. The speed of everything is scaled by a multiplier that eases
+// towards a target, the levels set it for their boss waves and the
+// console's scroll command can set it at any time.
+type Parallax struct {
+	Layers    []Layer
+	Starfield *Starfield
+	Speed     float64
+	images    []*Image
+	missing   bool
+	offsets   []float64
+	target    float64
+	step      float64
+	level     int
+	scroll    float64
+
+	stars      []Star
+	starOffset float64
+	seed       int64
+	frame      int
+}
+
+// backgroundLayers returns the layers of a level, levels with neither
+// layers nor a starfield use the built in background.
+func (l Level) backgroundLayers() []Layer {
+	if len(l.Background) == 0 && l.Starfield == nil {
+		return defaultLayers
+	}
+	return l.Background
+}
+
+// scrollSpeed returns how fast the level scrolls, during the boss wave or
+// otherwise.
+func (l Level) scrollSpeed(boss bool) float64 {
+	s := l.Scroll
+	if boss && l.BossScroll != 0 {
+		s = l.BossScroll
+	}
+	if s == 0 {
+		s = 1
+	}
+	return s
+}
+
+func (p *Parallax) SetLayers(layers []Layer) {
+	p.Layers = nil
+	p.images = make([]*Image, 0, len(layers))
+	p.missing = false
+	for _, l := range layers {
+		m := assets.Image(l.Image)
+		if m.Placeholder {
+			p.missing = true
+			continue
+		}
+		p.Layers = append(p.Layers, l)
+		p.images = append(p.images, m)
+	}
+	p.offsets = make([]float64, len(p.Layers))
+}
+
+// ScrollTo changes the scroll speed multiplier over a number of frames.
+func (p *Parallax) ScrollTo(speed float64, frames int) {
+	p.target = speed
+	if frames <= 0 {
+		p.Speed = speed
+		return
+	}
+	p.step = math.Abs(speed-p.Speed) / float64(frames)
+}
+
+// SetStarfield generates the stars of a starfield, nil removes them.
+func (p *Parallax) SetStarfield(s *Starfield, seed int64) {
+	p.Starfield = s
+	p.stars = nil
+	p.starOffset = 0
+	p.seed = seed
+	if s != nil {
+		p.stars = genStars(s, seed, WIDTH, HEIGHT)
+	}
+}
+
+func (p *Parallax) Update() {
+	l, i, boss := currentLevel()
+	if p.images == nil || i != p.level {
+		p.level = i
+		p.SetLayers(l.backgroundLayers())
+		p.Speed = l.scrollSpeed(boss)
+		p.target, p.scroll = p.Speed, p.Speed
+		p.Starfield = nil
+	}
+	stars := l.Starfield
+	if stars == nil && p.missing {
+		stars = fallbackStars
+	}
+	// a new game brings a new seed and with it a new sky
+	if stars != p.Starfield || (stars != nil && starSeed(stars, i) != p.seed) {
+		seed := int64(0)
+		if stars != nil {
+			seed = starSeed(stars, i)
+		}
+		p.SetStarfield(stars, seed)
+	}
+	if s := l.scrollSpeed(boss); s != p.scroll {
+		p.scroll = s
+		p.ScrollTo(s, FPS)
+	}
+
+	switch {
+	case p.Speed < p.target:
+		p.Speed = math.Min(p.Speed+p.step, p.target)
+	case p.Speed > p.target:
+		p.Speed = math.Max(p.Speed-p.step, p.target)
+	}
+
+	p.frame++
+	if p.Starfield != nil {
+		// every layer moves a whole screen when the offset wraps around
+		n := math.Max(float64(p.Starfield.Layers), 1)
+		p.starOffset = math.Mod(p.starOffset+p.Starfield.Speed*p.Speed, HEIGHT*n)
+	}
+	for i, l := range p.Layers {
+		h := float64(p.images[i].Bounds().Dy())
+		p.offsets[i] = math.Mod(p.offsets[i]+l.Speed*p.Speed, h)
+		if p.offsets[i] < 0 {
+			p.offsets[i] += h
+		}
+	}
+}
+
+func (p *Parallax) Blit() {
+	if p.Starfield != nil {
+		p.blitStars()
+	}
+
+	b := canvas.Bounds()
+	for i, l := range p.Layers {
+		m := p.images[i]
+		r := m.Bounds()
+		w, h := r.Dx(), r.Dy()
+		if w <= 0 || h <= 0 {
+			continue
+		}
+
+		for y := int(p.offsets[i]) - h; y < b.Dy(); y += h {
+			if !l.Tile {
+				m.Blit(l.X, y)
+				continue
+			}
+			for x := l.X%w - w; x < b.Dx(); x += w {
+				m.Blit(x, y)
+			}
+		}
+	}
+}
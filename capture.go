@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/qeedquan/go-media/sdl"
+	"github.com/qeedquan/go-media/sdl/sdlttf"
+)
+
+// Recorder keeps the last frames drawn so they can be saved as a clip. Only
+// one frame in every few is kept, scaled down, to keep the memory it needs
+// reasonable.
+type Recorder struct {
+	frames []*image.RGBA
+	head   int
+	size   int
+	every  int
+	scale  int
+	count  int
+}
+
+func newRecorder(frames, every, scale int) *Recorder {
+	if every < 1 {
+		every = 1
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	return &Recorder{
+		frames: make([]*image.RGBA, frames),
+		every:  every,
+		scale:  scale,
+	}
+}
+
+// newClipRecorder creates a recorder for the clip length and frame rate set
+// in the config.
+func newClipRecorder() *Recorder {
+	c := conf.Capture
+	if c.Seconds <= 0 || c.FPS <= 0 {
+		return nil
+	}
+	every := FPS / c.FPS
+	if every < 1 {
+		every = 1
+	}
+	return newRecorder(c.Seconds*FPS/every, every, c.Scale)
+}
+
+// Capture keeps a copy of the canvas if it is one of the frames that are
+// kept, the oldest frame is overwritten once the recorder is full.
+func (r *Recorder) Capture(m *image.RGBA) {
+	if r == nil || len(r.frames) == 0 {
+		return
+	}
+	if r.count++; (r.count-1)%r.every != 0 {
+		return
+	}
+
+	b := m.Bounds()
+	w, h := b.Dx()/r.scale, b.Dy()/r.scale
+	i := (r.head + r.size) % len(r.frames)
+	f := r.frames[i]
+	if f == nil || f.Bounds().Dx() != w || f.Bounds().Dy() != h {
+		f = image.NewRGBA(image.Rect(0, 0, w, h))
+		r.frames[i] = f
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			j := m.PixOffset(b.Min.X+x*r.scale, b.Min.Y+y*r.scale)
+			copy(f.Pix[f.PixOffset(x, y):][:4], m.Pix[j:j+4])
+		}
+	}
+
+	if r.size < len(r.frames) {
+		r.size++
+	} else {
+		r.head = (r.head + 1) % len(r.frames)
+	}
+}
+
+// Take returns the frames kept so far from oldest to newest and empties the
+// recorder. Frames of a different size than the newest, from before the
+// screen changed size, are left out.
+func (r *Recorder) Take() []*image.RGBA {
+	var frames []*image.RGBA
+	if r == nil || r.size == 0 {
+		return frames
+	}
+	last := r.frames[(r.head+r.size-1)%len(r.frames)].Bounds()
+	for i := 0; i < r.size; i++ {
+		f := r.frames[(r.head+i)%len(r.frames)]
+		if f.Bounds() == last {
+			frames = append(frames, f)
+		}
+	}
+	r.frames = make([]*image.RGBA, len(r.frames))
+	r.head, r.size = 0, 0
+	return frames
+}
+
+// Delay is how long every kept frame stays on screen.
+func (r *Recorder) Delay() time.Duration {
+	return time.Duration(r.every) * time.Second / FPS
+}
+
+// saveClip writes the frames as an animated PNG when the name ends in .png
+// or .apng and as a GIF otherwise.
+func saveClip(name string, frames []*image.RGBA, delay time.Duration) error {
+	if len(frames) == 0 {
+		return errors.New("no frames to save")
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".apng":
+		err = encodeAPNG(w, frames, delay)
+	default:
+		err = encodeGIF(w, frames, delay)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	xerr := f.Close()
+	if err == nil {
+		err = xerr
+	}
+	return err
+}
+
+func encodeGIF(w io.Writer, frames []*image.RGBA, delay time.Duration) error {
+	g := &gif.GIF{}
+	cs := int(delay / (10 * time.Millisecond))
+	if cs < 2 {
+		cs = 2
+	}
+	for _, f := range frames {
+		p := image.NewPaletted(f.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), f, f.Bounds().Min)
+		g.Image = append(g.Image, p)
+		g.Delay = append(g.Delay, cs)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// encodeAPNG writes the frames as an animated PNG. Every frame is stored as
+// 8 bit RGBA, the color type the header declares for all of them, with no
+// filtering. Write errors are left for the buffered writer to report.
+func encodeAPNG(w io.Writer, frames []*image.RGBA, delay time.Duration) error {
+	b := frames[0].Bounds()
+	seq := uint32(0)
+
+	io.WriteString(w, "\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	ihdr[8] = 8
+	ihdr[9] = 6
+	writeChunk(w, "IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	writeChunk(w, "acTL", actl)
+
+	for i, f := range frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delay/time.Millisecond))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		writeChunk(w, "fcTL", fctl)
+		seq++
+
+		data, err := apngFrame(f)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			writeChunk(w, "IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, seq)
+		copy(fdat[4:], data)
+		writeChunk(w, "fdAT", fdat)
+		seq++
+	}
+	writeChunk(w, "IEND", nil)
+	return nil
+}
+
+// apngFrame compresses the pixels of a frame the way PNG stores them, every
+// row starts with a filter type of 0 for none.
+func apngFrame(m *image.RGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	b := m.Bounds()
+	row := make([]byte, 1+4*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := m.PixOffset(b.Min.X, y)
+		copy(row[1:], m.Pix[i:i+4*b.Dx()])
+		if _, err := z.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	w.Write(hdr[:])
+	w.Write(data)
+	w.Write(sum[:])
+}
+
+// saveRecording saves the clip kept by the recorder to the pref directory,
+// it is encoded in the background so the game does not stop.
+func saveRecording() {
+	frames := recorder.Take()
+	if len(frames) == 0 {
+		return
+	}
+	ext := ".gif"
+	if conf.Capture.Format == "apng" {
+		ext = ".png"
+	}
+	name := filepath.Join(conf.Pref, time.Now().Format("espada-20060102-150405")+ext)
+	delay := recorder.Delay()
+	status.Set("Saving clip", 60)
+	go func() {
+		if !ek(saveClip(name, frames, delay)) {
+			sdl.Log("saved clip %v", name)
+		}
+	}()
+}
+
+// initHeadless sets up what is needed to draw the game without a window,
+// sounds go to an audio backend that needs no device.
+func initHeadless(a Audio) {
+	ck(sdlttf.Init())
+
+	audio = a
+	mixer.Init(MAX_CHANNELS)
+
+	var err error
+	canvas = image.NewRGBA(image.Rect(0, 0, WIDTH, HEIGHT))
+	surface, err = sdl.CreateRGBSurface(sdl.SWSURFACE, WIDTH, HEIGHT, 32, 0x00FF0000, 0x0000FF00, 0x000000FF, 0xFF000000)
+	ck(err)
+}
+
+// playReplay plays a replay back without a display, drawing every frame the
+// way it was seen while it was played and passing it to frame. The random
+// numbers used for particles and screen shake are seeded from the replay so
+// it is drawn the same way every time.
+func playReplay(r *Replay, frame func(n int)) error {
+	p, err := newReplayPlayer(r)
+	if err != nil {
+		return err
+	}
+	rand.Seed(r.Seed)
+	state = PLAY
+	startWorlds(p.Worlds)
+
+	for n := 0; ; n++ {
+		held := holdWorlds()
+		if !held && !p.Step() {
+			break
+		}
+		for _, w := range p.Worlds {
+			if !held {
+				w.Animate()
+			}
+			w.animateCamera()
+		}
+		render()
+		frame(n)
+	}
+	return p.Err
+}
+
+// renderReplay turns a replay file into a clip of its last seconds for bug
+// reports.
+func renderReplay(out, file string) error {
+	r, err := loadReplay(file)
+	if err != nil {
+		return err
+	}
+
+	initHeadless(nullAudio{})
+	loadAssets()
+	rec := newClipRecorder()
+	if rec == nil {
+		return errors.New("clips are turned off, Capture.Seconds and Capture.FPS have to be set")
+	}
+	err = playReplay(r, func(int) {
+		rec.Capture(canvas)
+	})
+	if err != nil {
+		return err
+	}
+
+	frames := rec.Take()
+	if err := saveClip(out, frames, rec.Delay()); err != nil {
+		return err
+	}
+	fmt.Printf("rendered %d frames of %v into %v\n", len(frames), file, out)
+	return nil
+}
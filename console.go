@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+const (
+	MAX_CONSOLE_OUTPUT  = 100
+	MAX_CONSOLE_HISTORY = 50
+)
+
+// Console is the developer console that drops down with the backtick key.
+// While it is open the keyboard types into it instead of playing, the text
+// comes from SDL's text input so it follows the keyboard layout.
+type Console struct {
+	Open    bool
+	Line    string
+	Output  []string
+	History []string
+	browse  int
+}
+
+// Command is something the console can run. Commands that change the game
+// only run in local games, anything else would desync netplay. Freezing and
+// rewinding are checked by the debugger, which also allows them once the
+// game is over.
+type Command struct {
+	Name     string
+	Args     string
+	Help     string
+	Complete []string
+	Game     bool
+	Run      func(args []string) error
+}
+
+var (
+	commands []*Command
+
+	nextSeed   int64
+	screenshot bool
+)
+
+var errUsage = errors.New("usage")
+
+func init() {
+	commands = []*Command{
+		{Name: "help", Help: "list the commands", Run: cmdHelp},
+		{Name: "clear", Help: "clear the console", Run: cmdClear},
+		{Name: "god", Help: "toggle invincibility", Game: true, Run: cmdGod},
+		{Name: "wave", Args: "N", Help: "jump to a wave", Game: true, Run: cmdWave},
+		{Name: "spawn", Args: "kind x y", Help: "spawn an enemy", Complete: enemyClips[:], Game: true, Run: cmdSpawn},
+		{Name: "give", Args: "bomb|health", Help: "give every player a powerup", Complete: []string{"bomb", "health"}, Game: true, Run: cmdGive},
+		{Name: "score", Args: "N", Help: "set the score of every player", Game: true, Run: cmdScore},
+		{Name: "timescale", Args: "scale", Help: "run the game slower or faster", Run: cmdTimescale},
+		{Name: "freeze", Help: "stop or restart the game", Run: cmdFreeze},
+		{Name: "step", Args: "[N]", Help: "run a frozen game for N frames", Run: cmdStep},
+		{Name: "rewind", Args: "[N]", Help: "rewind the game N frames", Run: cmdRewind},
+		{Name: "scroll", Args: "speed [N]", Help: "ease the background scroll speed over N frames", Run: cmdScroll},
+		{Name: "seed", Args: "N", Help: "set the seed of the next game", Run: cmdSeed},
+		{Name: "screenshot", Help: "save a screenshot", Run: cmdScreenshot},
+	}
+}
+
+func (c *Console) Toggle() {
+	c.Open = !c.Open
+	c.browse = len(c.History)
+	if c.Open {
+		sdl.StartTextInput()
+	} else {
+		sdl.StopTextInput()
+	}
+}
+
+func (c *Console) Printf(format string, args ...interface{}) {
+	for _, line := range strings.Split(fmt.Sprintf(format, args...), "\n") {
+		c.Output = append(c.Output, line)
+	}
+	if n := len(c.Output); n > MAX_CONSOLE_OUTPUT {
+		c.Output = c.Output[n-MAX_CONSOLE_OUTPUT:]
+	}
+}
+
+func (c *Console) Key(ev sdl.KeyDownEvent) {
+	switch ev.Sym {
+	case sdl.K_ESCAPE:
+		c.Toggle()
+	case sdl.K_RETURN:
+		line := c.Line
+		c.Line = ""
+		c.Exec(line)
+	case sdl.K_BACKSPACE:
+		if n := len(c.Line); n > 0 {
+			c.Line = c.Line[:n-1]
+		}
+	case sdl.K_UP:
+		if c.browse > 0 {
+			c.browse--
+			c.Line = c.History[c.browse]
+		}
+	case sdl.K_DOWN:
+		if c.browse < len(c.History) {
+			c.browse++
+		}
+		c.Line = ""
+		if c.browse < len(c.History) {
+			c.Line = c.History[c.browse]
+		}
+	case sdl.K_TAB:
+		c.complete()
+	}
+}
+
+// Text types text into the line, the backtick that toggles the console is
+// left out.
+func (c *Console) Text(ev sdl.TextInputEvent) {
+	// the text is NUL terminated when it is shorter than the event
+	text := strings.TrimRight(string(ev.Text[:]), "\x00")
+	c.Line += strings.Replace(text, "`", "", -1)
+}
+
+func (c *Console) Exec(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if n := len(c.History); n == 0 || c.History[n-1] != line {
+		c.History = append(c.History, line)
+		if n+1 > MAX_CONSOLE_HISTORY {
+			c.History = c.History[1:]
+		}
+	}
+	c.browse = len(c.History)
+	c.Printf("] %s", line)
+
+	args := strings.Fields(line)
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		c.Printf("unknown command %q, try help", args[0])
+		return
+	}
+	if cmd.Game && (state != PLAY || len(worlds) == 0 || session != nil || spectator != nil) {
+		c.Printf("%s only works in a local game", cmd.Name)
+		return
+	}
+	if cmd.Game && caster != nil {
+		c.Printf("%s does not work while broadcasting", cmd.Name)
+		return
+	}
+
+	err := cmd.Run(args[1:])
+	if err == errUsage {
+		err = fmt.Errorf("usage: %s %s", cmd.Name, cmd.Args)
+	}
+	if err != nil {
+		c.Printf("%v", err)
+	}
+}
+
+// complete completes the command being typed, or its first argument, as far
+// as all the choices agree and lists them when there is more than one.
+func (c *Console) complete() {
+	args := strings.Fields(c.Line)
+	if strings.HasSuffix(c.Line, " ") {
+		args = append(args, "")
+	}
+
+	var choices []string
+	switch len(args) {
+	case 0, 1:
+		args = append(args, "")[:1]
+		for _, cmd := range commands {
+			choices = append(choices, cmd.Name)
+		}
+	case 2:
+		if cmd := findCommand(args[0]); cmd != nil {
+			choices = cmd.Complete
+		}
+	default:
+		return
+	}
+
+	word := args[len(args)-1]
+	var matches []string
+	for _, s := range choices {
+		if strings.HasPrefix(s, word) {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Strings(matches)
+
+	prefix := matches[0]
+	for _, s := range matches[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	args[len(args)-1] = prefix
+	c.Line = strings.Join(args, " ")
+	if len(matches) == 1 {
+		c.Line += " "
+	} else {
+		c.Printf("%s", strings.Join(matches, " "))
+	}
+}
+
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Blit draws the console over the top half of the screen.
+func (c *Console) Blit() {
+	if !c.Open {
+		return
+	}
+
+	b := canvas.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy()/2)
+	draw.Draw(canvas, r, image.NewUniform(color.RGBA{0, 0, 32, 200}), image.ZP, draw.Over)
+	draw.Draw(canvas, image.Rect(0, r.Max.Y, r.Max.X, r.Max.Y+2), image.NewUniform(color.RGBA{128, 128, 160, 255}), image.ZP, draw.Src)
+
+	y := r.Max.Y - 24
+	blitText(5, y, "] "+c.Line+"_")
+	for i := len(c.Output) - 1; i >= 0 && y > 18; i-- {
+		y -= 18
+		if c.Output[i] != "" {
+			blitText(5, y, c.Output[i])
+		}
+	}
+}
+
+// cheated keeps the game from being submitted to the leaderboard.
+func cheated() {
+	if replay != nil {
+		sdl.Log("scores from this game will not be submitted")
+		replay = nil
+	}
+}
+
+func cmdHelp(args []string) error {
+	for _, cmd := range commands {
+		console.Printf("%-10s %-12s %s", cmd.Name, cmd.Args, cmd.Help)
+	}
+	return nil
+}
+
+func cmdClear(args []string) error {
+	console.Output = nil
+	return nil
+}
+
+func cmdGod(args []string) error {
+	toggleInvincible()
+	console.Printf("invincible: %v", toggle(conf.Invincible))
+	return nil
+}
+
+func cmdWave(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return errUsage
+	}
+
+	cheated()
+	for _, w := range worlds {
+		w.EnemyWaves = n
+		w.Status.Set(fmt.Sprintf("Wave: %d", n), 120)
+	}
+	return nil
+}
+
+func cmdSpawn(args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	kind := -1
+	for i, name := range enemyClips {
+		if args[0] == name || args[0] == strconv.Itoa(i) {
+			kind = i
+		}
+	}
+	x, xerr := strconv.Atoi(args[1])
+	y, yerr := strconv.Atoi(args[2])
+	if kind < 0 || xerr != nil || yerr != nil {
+		return errUsage
+	}
+
+	cheated()
+	for _, w := range worlds {
+		for _, e := range w.Enemies {
+			if e.Alive {
+				continue
+			}
+			w.resetEnemy(e, kind)
+			e.X, e.Y = int32(x), int32(y)
+			w.TotalEnemies++
+			break
+		}
+	}
+	return nil
+}
+
+func cmdGive(args []string) error {
+	if len(args) != 1 || (args[0] != "bomb" && args[0] != "health") {
+		return errUsage
+	}
+
+	cheated()
+	for _, w := range worlds {
+		for _, p := range w.Players {
+			switch {
+			case args[0] == "bomb" && p.Bombs < MAX_BOMBS:
+				p.Bombs++
+			case args[0] == "health":
+				p.Health = MAX_HEALTH
+			}
+		}
+	}
+	return nil
+}
+
+func cmdScore(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	n, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errUsage
+	}
+
+	cheated()
+	for _, w := range worlds {
+		for _, p := range w.Players {
+			p.Score = n
+		}
+	}
+	return nil
+}
+
+func cmdTimescale(args []string) error {
+	if len(args) == 0 {
+		console.Printf("timescale: %v", timescale)
+		return nil
+	}
+	s, err := strconv.ParseFloat(args[0], 64)
+	if len(args) != 1 || err != nil || s < MIN_TIMESCALE || s > MAX_TIMESCALE {
+		return errUsage
+	}
+	return setTimescale(s)
+}
+
+func cmdFreeze(args []string) error {
+	return debug.Freeze(!debug.Frozen)
+}
+
+func cmdStep(args []string) error {
+	n, err := countArg(args)
+	if err != nil {
+		return err
+	}
+	if err := debug.Freeze(true); err != nil {
+		return err
+	}
+	debug.steps += n
+	return nil
+}
+
+func cmdRewind(args []string) error {
+	n, err := countArg(args)
+	if err != nil {
+		return err
+	}
+	if caster != nil {
+		return errors.New("games being broadcast cannot be rewound")
+	}
+	if err := debug.Freeze(true); err != nil {
+		return err
+	}
+	for i := 0; i < n && debug.Rewind(); i++ {
+	}
+	return nil
+}
+
+func cmdScroll(args []string) error {
+	if len(args) == 0 {
+		console.Printf("scroll: %v", background.Speed)
+		return nil
+	}
+	speed, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || len(args) > 2 {
+		return errUsage
+	}
+	frames := 0
+	if len(args) == 2 {
+		frames, err = strconv.Atoi(args[1])
+		if err != nil || frames < 0 {
+			return errUsage
+		}
+	}
+	background.ScrollTo(speed, frames)
+	return nil
+}
+
+// countArg parses the optional count a command takes, 1 when there is none.
+func countArg(args []string) (int, error) {
+	switch len(args) {
+	case 0:
+		return 1, nil
+	case 1:
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return 0, errUsage
+		}
+		return n, nil
+	}
+	return 0, errUsage
+}
+
+func cmdSeed(args []string) error {
+	if len(args) == 0 {
+		if len(worlds) > 0 {
+			console.Printf("seed: %d", worlds[0].Seed)
+		}
+		return nil
+	}
+	n, err := strconv.ParseInt(args[0], 10, 64)
+	if len(args) != 1 || err != nil || n == 0 {
+		return errUsage
+	}
+	nextSeed = n
+	console.Printf("the next game starts with seed %d", n)
+	return nil
+}
+
+func cmdScreenshot(args []string) error {
+	screenshot = true
+	return nil
+}
+
+// saveScreenshot saves what is on the canvas to the pref directory.
+func saveScreenshot() (string, error) {
+	name := filepath.Join(conf.Pref, time.Now().Format("espada-20060102-150405.png"))
+	return name, savePNG(name, canvas)
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+// REWIND_FRAMES is how many frames of local games are kept to rewind.
+const REWIND_FRAMES = 5 * FPS
+
+// Debug is the developer overlay toggled with F3. It shows how long frames
+// take and the state of every world, draws hitboxes and how far everything
+// moved since the last frame, and lists the fields of the entity picked by
+// clicking on it or cycling through them with tab.
+//
+// With the overlay on, F5 freezes the game while it keeps being drawn, F6
+// runs a frozen game for a single frame, F7 and F8 halve and double the
+// timescale and holding F9 rewinds the game.
+type Debug struct {
+	On        bool
+	Selected  DebugRef
+	Frozen    bool
+	fps       float64
+	frameTime time.Duration
+	workTime  time.Duration
+	positions map[DebugRef]image.Point
+	steps     int
+	rewinding bool
+
+	// a ring of the last frames of every world
+	history [REWIND_FRAMES][]*World
+	head    int
+	size    int
+}
+
+// DebugRef refers to an entity by where it is in its world rather than by
+// pointer, rollback replaces the entities of a world every frame.
+type DebugRef struct {
+	World int
+	Kind  string
+	Owner int
+	Index int
+}
+
+type debugEntity struct {
+	Ref   DebugRef
+	Rect  image.Rectangle
+	Value interface{}
+	Color color.RGBA
+}
+
+var (
+	debugPlayer      = color.RGBA{64, 255, 64, 255}
+	debugEnemy       = color.RGBA{255, 64, 64, 255}
+	debugPlayerLaser = color.RGBA{255, 255, 64, 255}
+	debugEnemyLaser  = color.RGBA{255, 160, 64, 255}
+	debugPickup      = color.RGBA{64, 255, 255, 255}
+	debugSelected    = color.RGBA{255, 255, 255, 255}
+)
+
+func (d *Debug) Toggle() {
+	d.On = !d.On
+	d.positions = make(map[DebugRef]image.Point)
+	sdl.Log("debug overlay: %v", toggle(d.On))
+}
+
+func (d *Debug) Key(ev sdl.KeyDownEvent) {
+	if ev.Sym == sdl.K_F3 && !ev.Repeat {
+		d.Toggle()
+	}
+	if !d.On {
+		return
+	}
+
+	var err error
+	switch ev.Sym {
+	case sdl.K_TAB:
+		d.SelectNext()
+	case sdl.K_F5:
+		if !ev.Repeat {
+			err = d.Freeze(!d.Frozen)
+		}
+	case sdl.K_F6:
+		if err = d.Freeze(true); err == nil {
+			d.steps++
+		}
+	case sdl.K_F7:
+		err = setTimescale(math.Max(timescale/2, MIN_TIMESCALE))
+	case sdl.K_F8:
+		err = setTimescale(math.Min(timescale*2, MAX_TIMESCALE))
+	case sdl.K_F9:
+		if err = d.Freeze(true); err == nil {
+			d.rewinding = true
+		}
+	}
+	if err != nil {
+		status.Set(err.Error(), 120)
+	}
+}
+
+func (d *Debug) KeyUp(ev sdl.KeyUpEvent) {
+	if ev.Sym == sdl.K_F9 {
+		d.rewinding = false
+	}
+}
+
+// Freeze stops or restarts a local game, one that is over can be frozen to
+// rewind back into it.
+func (d *Debug) Freeze(frozen bool) error {
+	if frozen && ((state != PLAY && state != GAMEOVER) || session != nil || spectator != nil) {
+		return errors.New("only local games can be frozen")
+	}
+	d.Frozen = frozen
+	d.steps = 0
+	d.rewinding = false
+	return nil
+}
+
+// Update runs a frozen game for the frames that were stepped, or rewinds it
+// by a frame while the rewind key is held.
+func (d *Debug) Update() {
+	if d.rewinding {
+		d.Rewind()
+		return
+	}
+	for ; d.steps > 0; d.steps-- {
+		step()
+	}
+}
+
+// Record keeps a copy of the worlds of a local game after every frame.
+func (d *Debug) Record(ws []*World) {
+	snap := make([]*World, len(ws))
+	for i, w := range ws {
+		snap[i] = w.Clone()
+	}
+	d.history[(d.head+d.size)%REWIND_FRAMES] = snap
+	if d.size < REWIND_FRAMES {
+		d.size++
+	} else {
+		d.head = (d.head + 1) % REWIND_FRAMES
+	}
+}
+
+// Rewind puts the worlds back the way they were a frame ago. The game no
+// longer matches its replay, so it is not submitted to the leaderboard.
+func (d *Debug) Rewind() bool {
+	if d.size < 2 || caster != nil {
+		return false
+	}
+	snap := d.history[(d.head+d.size-2)%REWIND_FRAMES]
+	if len(snap) != len(worlds) {
+		return false
+	}
+
+	d.size--
+	d.history[(d.head+d.size)%REWIND_FRAMES] = nil
+	for i, w := range worlds {
+		w.Restore(snap[i])
+	}
+	cheated()
+	if state == GAMEOVER && !gameOver() {
+		state = PLAY
+		status.Set("", 0)
+	}
+	return true
+}
+
+// Clear forgets the frames of the last game.
+func (d *Debug) Clear() {
+	for i := range d.history {
+		d.history[i] = nil
+	}
+	d.head, d.size = 0, 0
+	d.Frozen = false
+}
+
+// Frame records how long the last frame took in total and how much of it
+// was spent working rather than waiting for the next one.
+func (d *Debug) Frame(work, total time.Duration) {
+	d.workTime, d.frameTime = work, total
+	if total > 0 {
+		d.fps += (float64(time.Second)/float64(total) - d.fps) * 0.1
+	}
+}
+
+// debugEntities lists everything in a world the overlay knows how to show.
+func (w *World) debugEntities(n int) []debugEntity {
+	var list []debugEntity
+	add := func(kind string, owner, index int, r sdl.Rect, v interface{}, c color.RGBA) {
+		list = append(list, debugEntity{
+			Ref:   DebugRef{n, kind, owner, index},
+			Rect:  image.Rect(int(r.X), int(r.Y), int(r.X+r.W), int(r.Y+r.H)),
+			Value: v,
+			Color: c,
+		})
+	}
+
+	for i, p := range w.Players {
+		if p.Alive {
+			add("player", 0, i, p.Rect, p, debugPlayer)
+		}
+		for j, l := range p.Lasers {
+			if l.Alive {
+				add("player laser", i, j, l.Rect, l, debugPlayerLaser)
+			}
+		}
+	}
+	for i, e := range w.Enemies {
+		if e.Alive {
+			add("enemy", 0, i, e.Rect, e, debugEnemy)
+		}
+		for j, l := range e.Lasers {
+			if l.Alive {
+				add("enemy laser", i, j, l.Rect, l, debugEnemyLaser)
+			}
+		}
+	}
+	for i, p := range w.Pickups {
+		if p.Alive {
+			add("pickup", 0, i, p.Rect, p, debugPickup)
+		}
+	}
+	return list
+}
+
+// Click selects the entity under the mouse, lasers are small so the closest
+// thing within a few pixels is picked.
+func (d *Debug) Click(x, y int) {
+	n := x / WIDTH
+	if n >= len(worlds) {
+		return
+	}
+	pt := image.Pt(x%WIDTH, y)
+
+	d.Selected = DebugRef{}
+	best := -1
+	for _, e := range worlds[n].debugEntities(n) {
+		r := e.Rect.Inset(-4)
+		if !pt.In(r) {
+			continue
+		}
+		c := e.Rect.Min.Add(e.Rect.Max).Div(2).Sub(pt)
+		if dist := c.X*c.X + c.Y*c.Y; best < 0 || dist < best {
+			best = dist
+			d.Selected = e.Ref
+		}
+	}
+}
+
+// SelectNext cycles the selection through the entities of every world.
+func (d *Debug) SelectNext() {
+	var list []debugEntity
+	for n, w := range worlds {
+		list = append(list, w.debugEntities(n)...)
+	}
+	if len(list) == 0 {
+		d.Selected = DebugRef{}
+		return
+	}
+
+	next := 0
+	for i, e := range list {
+		if e.Ref == d.Selected {
+			next = (i + 1) % len(list)
+			break
+		}
+	}
+	d.Selected = list[next].Ref
+}
+
+// Blit draws the overlay of a world into the canvas of that world.
+func (d *Debug) Blit(w *World, n int) {
+	var selected *debugEntity
+	entities := w.debugEntities(n)
+	for i := range entities {
+		e := &entities[i]
+		c := e.Color
+		if e.Ref == d.Selected {
+			c = debugSelected
+			selected = e
+		}
+		outline(e.Rect, c)
+
+		// velocity is taken from how far the entity moved since it was
+		// last drawn, so it works the same for everything
+		center := e.Rect.Min.Add(e.Rect.Max).Div(2)
+		if last, ok := d.positions[e.Ref]; ok {
+			if v := center.Sub(last); v != image.ZP {
+				line(center, center.Add(v.Mul(8)), c)
+			}
+		}
+		d.positions[e.Ref] = center
+	}
+
+	lasers := 0
+	for _, e := range entities {
+		if e.Ref.Kind == "player laser" || e.Ref.Kind == "enemy laser" {
+			lasers++
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("frame %d", w.Frame),
+		fmt.Sprintf("waves %d", w.EnemyWaves),
+		fmt.Sprintf("spawn timer %d", w.EnemySpawnTimer),
+		fmt.Sprintf("total enemies %d", w.TotalEnemies),
+		fmt.Sprintf("projectiles %d", lasers),
+	}
+	if w.Particles != nil {
+		lines = append(lines, fmt.Sprintf("particles %d", len(w.Particles.parts)))
+	}
+	if n == 0 {
+		lines = append([]string{
+			fmt.Sprintf("%.1f fps", d.fps),
+			fmt.Sprintf("frame %.1f ms", d.frameTime.Seconds()*1000),
+			fmt.Sprintf("work %.1f ms", d.workTime.Seconds()*1000),
+			fmt.Sprintf("timescale %v", timescale),
+			fmt.Sprintf("rewind %d/%d", d.size, REWIND_FRAMES),
+		}, lines...)
+		if d.Frozen {
+			lines = append(lines, "frozen")
+		}
+	}
+	blitPanel(5, 60, lines)
+
+	if selected != nil {
+		r := selected.Ref
+		title := fmt.Sprintf("%s %d", r.Kind, r.Index)
+		if r.Kind == "player laser" || r.Kind == "enemy laser" {
+			title = fmt.Sprintf("%s %d.%d", r.Kind, r.Owner, r.Index)
+		}
+		fields := append([]string{title}, inspect(selected.Value)...)
+		for i := 0; i < len(fields); i += 20 {
+			end := i + 20
+			if end > len(fields) {
+				end = len(fields)
+			}
+			blitPanel(WIDTH-210*(i/20+1), 60, fields[i:end])
+		}
+	}
+}
+
+// inspect lists the exported fields of a struct, fields of embedded structs
+// are listed as if they were its own and slices only show their length.
+func inspect(v interface{}) []string {
+	var lines []string
+	var walk func(rv reflect.Value)
+	walk = func(rv reflect.Value) {
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			fv := rv.Field(i)
+			switch {
+			case f.PkgPath != "":
+			case f.Anonymous && fv.Kind() == reflect.Struct:
+				walk(fv)
+			case fv.Kind() == reflect.Ptr:
+			case fv.Kind() == reflect.Slice:
+				lines = append(lines, fmt.Sprintf("%s: %d", f.Name, fv.Len()))
+			default:
+				lines = append(lines, fmt.Sprintf("%s: %v", f.Name, fv.Interface()))
+			}
+		}
+	}
+	walk(reflect.Indirect(reflect.ValueOf(v)))
+	return lines
+}
+
+func blitPanel(x, y int, lines []string) {
+	r := image.Rect(x, y, x+205, y+len(lines)*18+4)
+	draw.Draw(canvas, r, image.NewUniform(color.RGBA{0, 0, 0, 160}), image.ZP, draw.Over)
+	for i, text := range lines {
+		blitText(x+3, y+i*18, text)
+	}
+}
+
+func outline(r image.Rectangle, c color.RGBA) {
+	for x := r.Min.X; x < r.Max.X; x++ {
+		canvas.SetRGBA(x, r.Min.Y, c)
+		canvas.SetRGBA(x, r.Max.Y-1, c)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		canvas.SetRGBA(r.Min.X, y, c)
+		canvas.SetRGBA(r.Max.X-1, y, c)
+	}
+}
+
+func line(a, b image.Point, c color.RGBA) {
+	d := b.Sub(a)
+	n := d.X
+	if n < 0 {
+		n = -n
+	}
+	if d.Y > n {
+		n = d.Y
+	} else if -d.Y > n {
+		n = -d.Y
+	}
+	if n == 0 {
+		canvas.SetRGBA(a.X, a.Y, c)
+		return
+	}
+	for i := 0; i <= n; i++ {
+		canvas.SetRGBA(a.X+d.X*i/n, a.Y+d.Y*i/n, c)
+	}
+}
+
+const (
+	MIN_TIMESCALE = 0.125
+	MAX_TIMESCALE = 8
+)
+
+// setTimescale sets how many frames the game runs for every frame drawn.
+// Playing at any other speed than normal is cheating.
+func setTimescale(scale float64) error {
+	if session != nil || spectator != nil {
+		return errors.New("the timescale can not be changed in netplay or while spectating")
+	}
+	if scale != 1 {
+		cheated()
+	}
+	timescale = scale
+	return nil
+}
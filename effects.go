@@ -0,0 +1,144 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math/rand"
+)
+
+// TRAUMA_DECAY is how much trauma the camera recovers every frame.
+const TRAUMA_DECAY = 0.025
+
+// Camera shakes the view of a world by an amount that grows with the square
+// of its trauma, and holds the world still for a few frames of hit-stop.
+// Like particles it only affects what is drawn, so it is shared with clones
+// of the world and left out of checksums and snapshots.
+type Camera struct {
+	Trauma  float64
+	Offset  image.Point
+	HitStop int
+}
+
+var shakeBuffer *image.RGBA
+
+// effects reports whether screen effects should be started, they are left
+// out while the game is resimulated or nothing is drawn, and when they are
+// turned off in the options.
+func effects() bool {
+	return conf.Effects.Enabled && !silent && atlas != nil
+}
+
+func (w *World) camera() *Camera {
+	if w.Camera == nil {
+		w.Camera = &Camera{}
+	}
+	return w.Camera
+}
+
+func (w *World) shake(trauma float64) {
+	if !effects() || conf.Effects.Shake <= 0 {
+		return
+	}
+	c := w.camera()
+	if c.Trauma += trauma; c.Trauma > 1 {
+		c.Trauma = 1
+	}
+}
+
+// hitStop holds the world still for a number of frames. Netplay and
+// spectated games run on a clock shared with the other side so they never
+// stop.
+func (w *World) hitStop(frames int) {
+	if !effects() || session != nil || spectator != nil {
+		return
+	}
+	if c := w.camera(); frames > c.HitStop {
+		c.HitStop = frames
+	}
+}
+
+func (w *World) flash(e *Entity) {
+	if effects() {
+		e.Flash = conf.Effects.Flash
+	}
+}
+
+// spawnWreck blows up an enemy, its ship flashes white under the explosion
+// for a moment and destroying a big ship stops the game for a few frames.
+func (w *World) spawnWreck(e *Enemy) {
+	x := w.spawnExplosion(int(e.X), int(e.Y))
+	if x != nil && effects() {
+		x.Wreck = e.Anim
+		x.Flash = conf.Effects.Flash
+	}
+
+	if e.Kind > 0 {
+		w.shake(0.4)
+		w.hitStop(conf.Effects.HitStop)
+	} else {
+		w.shake(0.15)
+	}
+}
+
+// holdWorlds counts down the hit-stop of the worlds and reports whether they
+// are held still this frame.
+func holdWorlds() bool {
+	held := false
+	for _, w := range worlds {
+		if c := w.Camera; c != nil && c.HitStop > 0 {
+			c.HitStop--
+			held = true
+		}
+	}
+	return held
+}
+
+func (w *World) animateCamera() {
+	c := w.Camera
+	if c == nil {
+		return
+	}
+
+	c.Offset = image.ZP
+	if c.Trauma <= 0 {
+		return
+	}
+	s := c.Trauma * c.Trauma * float64(conf.Effects.Shake)
+	c.Offset = image.Pt(int(s*(rand.Float64()*2-1)), int(s*(rand.Float64()*2-1)))
+	c.Trauma -= TRAUMA_DECAY
+}
+
+// blitShake moves everything drawn so far by the camera offset.
+func (w *World) blitShake() {
+	if w.Camera == nil || w.Camera.Offset == image.ZP {
+		return
+	}
+
+	r := canvas.Bounds()
+	if shakeBuffer == nil || shakeBuffer.Bounds() != r {
+		shakeBuffer = image.NewRGBA(r)
+	}
+	draw.Draw(shakeBuffer, r, canvas, r.Min, draw.Src)
+	draw.Draw(canvas, r, image.Black, image.ZP, draw.Src)
+	draw.Draw(canvas, r.Add(w.Camera.Offset), shakeBuffer, r.Min, draw.Src)
+}
+
+// BlitFlash draws the sprite in solid white.
+func (s *Sprite) BlitFlash(x, y int) {
+	if s.flash == nil {
+		r := s.Bounds()
+		m := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				a := s.RGBAAt(r.Min.X+x, r.Min.Y+y).A
+				i := m.PixOffset(x, y)
+				m.Pix[i+0] = a
+				m.Pix[i+1] = a
+				m.Pix[i+2] = a
+				m.Pix[i+3] = a
+			}
+		}
+		s.flash = &Image{RGBA: m}
+	}
+	s.flash.Blit(x-s.Pivot.X, y-s.Pivot.Y)
+}
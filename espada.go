@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/color"
 	"image/draw"
@@ -14,11 +16,9 @@ import (
 	"runtime"
 	"time"
 
-	"github.com/qeedquan/go-media/image/imageutil"
 	"github.com/qeedquan/go-media/sdl"
 	"github.com/qeedquan/go-media/sdl/sdlgfx"
 	"github.com/qeedquan/go-media/sdl/sdlimage/sdlcolor"
-	"github.com/qeedquan/go-media/sdl/sdlmixer"
 	"github.com/qeedquan/go-media/sdl/sdlttf"
 )
 
@@ -30,14 +30,40 @@ const (
 
 	MAX_LASERS     = 5
 	MAX_ENEMIES    = 4
+	MAX_GARBAGE    = 4
 	MAX_EXPLOSIONS = 16
+	MAX_POPUPS     = 16
+	MAX_PICKUPS    = 4
 	MAX_HEALTH     = 5
+	MAX_GRAZE      = 100
+	MAX_BOMBS      = 5
 )
 
 const (
 	TITLE = iota
 	PLAY
 	GAMEOVER
+	DEMO
+)
+
+// In co-op, COOP_SHARED ends the game as soon as any player is destroyed,
+// while COOP_SPLIT lets the survivors play on until everyone is down.
+const (
+	COOP_SHARED = iota
+	COOP_SPLIT
+)
+
+const (
+	MODE_COOP = iota
+	MODE_VERSUS
+	MODE_SPLIT
+)
+
+const (
+	INPUT_ANY = -(iota + 1)
+	INPUT_KEYBOARD
+	INPUT_KEYBOARD_LEFT
+	INPUT_KEYBOARD_RIGHT
 )
 
 const (
@@ -50,6 +76,7 @@ const (
 	KDP
 	KDI
 	KRP
+	KDB
 )
 
 type Menu struct {
@@ -78,27 +105,35 @@ var (
 
 	ctls []*sdl.GameController
 
-	background struct {
-		Y int
-	}
-
-	player          *Player
-	enemies         []*Enemy
-	totalEnemies    int
-	explosions      []*Explosion
-	animationTimer  int
-	enemySpawnTimer int
-	enemyWaves      int
-	transitionTimer int
-	status          Status
+	background Parallax
+
+	worlds    []*World
+	views     []*image.RGBA
+	session   *Netplay
+	caster    *Broadcast
+	spectator *Spectator
+	board     Leaderboard
+	replay    *Replay
+	assets    *AssetLoader
+	atlas     *Atlas
+	emitters  map[string]*EmitterDef
+	recorder  *Recorder
+	audio     Audio
+	mixer     Mixer
+	music     Director
+	silent    bool
+	debug     Debug
+	console   Console
+	attract   Attract
+	timescale = 1.0
+	timestep  float64
+	status    Status
 
 	gfx struct {
-		background *Image
-		title      *Image
-		menu       struct {
+		title *Image
+		menu  struct {
 			cursor *Image
 		}
-		player *Image
 		health struct {
 			full  *Image
 			empty *Image
@@ -107,26 +142,66 @@ var (
 			player *Image
 			enemy  *Image
 		}
-		enemy     *Image
-		enemy2    *Image
-		explosion *Image
 	}
 	sfx struct {
-		music *sdlmixer.Music
-		fire  struct {
-			player *sdlmixer.Chunk
-			enemy  *sdlmixer.Chunk
+		fire struct {
+			player *Sound
+			enemy  *Sound
 		}
-		explosion *sdlmixer.Chunk
+		explosion *Sound
 	}
 )
 
 func main() {
 	runtime.LockOSThread()
 	rand.Seed(time.Now().UnixNano())
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "leaderboard-server":
+			runLeaderboardServer(os.Args[2:])
+			return
+		case "pack-atlas":
+			runPackAtlas(os.Args[2:])
+			return
+		case "export-replay":
+			runExportReplay(os.Args[2:])
+			return
+		}
+	}
 	parseFlags()
+	if conf.Validate {
+		if !validateAssets() {
+			os.Exit(1)
+		}
+		return
+	}
+	if n := conf.Netplay; n.Loopback > 0 {
+		if !runLoopback(n.Loopback, n.Loss, n.Lag, n.Delay) {
+			os.Exit(1)
+		}
+		return
+	}
+	if conf.Capture.Render != "" {
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: espada -render-replay out.gif replay.json")
+			os.Exit(2)
+		}
+		if err := renderReplay(conf.Capture.Render, flag.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	initSDL()
 	loadAssets()
+	if conf.Spectate.Broadcast != "" {
+		var err error
+		caster, err = newBroadcast(conf.Spectate.Broadcast)
+		ck(err)
+	}
+	if conf.Leaderboard.URL != "" {
+		board = newHTTPLeaderboard(conf.Leaderboard.URL)
+	}
 	loop()
 }
 
@@ -175,19 +250,42 @@ func parseFlags() {
 	flags.Defaults()
 	flag.StringVar(&flags.Assets, "assets", flags.Assets, "assets directory")
 	flag.StringVar(&flags.Pref, "pref", flags.Pref, "preference directory")
+	flag.StringVar(&flags.Audio, "audio", flags.Audio, "audio backend: sdl, null or record")
+	flag.BoolVar(&flags.Placeholders, "placeholders", flags.Placeholders, "draw placeholders for missing or broken images")
+	flag.BoolVar(&flags.Validate, "validate", flags.Validate, "check the assets and exit")
 	flag.BoolVar(&flags.Invincible, "invincible", flags.Invincible, "invincible")
 	flag.BoolVar(&flags.Fullscreen, "fullscreen", flags.Fullscreen, "fullscreen")
 	flag.BoolVar(&flags.Sound, "sound", flags.Sound, "enable sound")
 	flag.BoolVar(&flags.Music, "music", flags.Music, "enable music")
 	flag.IntVar(&flags.Volume.Sound, "soundvol", flags.Volume.Sound, "sound volume")
 	flag.IntVar(&flags.Volume.Music, "musicvol", flags.Volume.Music, "music volume")
+	flag.StringVar(&flags.Netplay.Host, "host", flags.Netplay.Host, "host a netplay game on address")
+	flag.StringVar(&flags.Netplay.Join, "join", flags.Netplay.Join, "join a netplay game at address")
+	flag.IntVar(&flags.Netplay.Delay, "delay", flags.Netplay.Delay, "netplay input delay in frames")
+	flag.IntVar(&flags.Netplay.Loss, "netloss", flags.Netplay.Loss, "simulated netplay packet loss percentage")
+	flag.IntVar(&flags.Netplay.Lag, "netlag", flags.Netplay.Lag, "simulated netplay lag in frames")
+	flag.IntVar(&flags.Netplay.Loopback, "loopback", flags.Netplay.Loopback, "run a headless netplay loopback test for this many frames")
+	flag.StringVar(&flags.Spectate.Broadcast, "broadcast", flags.Spectate.Broadcast, "let spectators watch games on address")
+	flag.StringVar(&flags.Spectate.Watch, "watch", flags.Spectate.Watch, "watch the game broadcast at address")
+	flag.StringVar(&flags.Leaderboard.URL, "leaderboard", flags.Leaderboard.URL, "leaderboard server url to submit scores to")
+	flag.StringVar(&flags.Leaderboard.Name, "name", flags.Leaderboard.Name, "name to submit scores under")
+	flag.StringVar(&flags.Capture.Render, "render-replay", flags.Capture.Render, "render the replay file given as argument into a gif or png clip and exit")
 	flag.Parse()
 
-	conf.Assets = flags.Assets
-	conf.Pref = flags.Pref
+	conf = flags
 	conf.Load()
 	flag.Visit(func(f *flag.Flag) {
 		switch f.Name {
+		case "assets":
+			conf.Assets = flags.Assets
+		case "pref":
+			conf.Pref = flags.Pref
+		case "audio":
+			conf.Audio = flags.Audio
+		case "placeholders":
+			conf.Placeholders = flags.Placeholders
+		case "validate":
+			conf.Validate = flags.Validate
 		case "invincible":
 			conf.Invincible = flags.Invincible
 		case "fullscreen":
@@ -200,6 +298,28 @@ func parseFlags() {
 			conf.Volume.Sound = flags.Volume.Sound
 		case "musicvol":
 			conf.Volume.Music = flags.Volume.Music
+		case "host":
+			conf.Netplay.Host = flags.Netplay.Host
+		case "join":
+			conf.Netplay.Join = flags.Netplay.Join
+		case "delay":
+			conf.Netplay.Delay = flags.Netplay.Delay
+		case "netloss":
+			conf.Netplay.Loss = flags.Netplay.Loss
+		case "netlag":
+			conf.Netplay.Lag = flags.Netplay.Lag
+		case "loopback":
+			conf.Netplay.Loopback = flags.Netplay.Loopback
+		case "broadcast":
+			conf.Spectate.Broadcast = flags.Spectate.Broadcast
+		case "watch":
+			conf.Spectate.Watch = flags.Spectate.Watch
+		case "leaderboard":
+			conf.Leaderboard.URL = flags.Leaderboard.URL
+		case "name":
+			conf.Leaderboard.Name = flags.Leaderboard.Name
+		case "render-replay":
+			conf.Capture.Render = flags.Capture.Render
 		}
 	})
 }
@@ -211,16 +331,11 @@ func initSDL() {
 	err = sdlttf.Init()
 	ck(err)
 
-	err = sdl.InitSubSystem(sdl.INIT_AUDIO)
-	ek(err)
-
-	err = sdlmixer.OpenAudio(44100, sdl.AUDIO_S16, 2, 8192)
-	ek(err)
-
-	_, err = sdlmixer.Init(sdlmixer.INIT_OGG)
-	ek(err)
-
-	sdlmixer.AllocateChannels(128)
+	audio = newAudio(conf.Audio)
+	if ek(audio.Open(MAX_CHANNELS)) {
+		audio = nullAudio{}
+	}
+	mixer.Init(MAX_CHANNELS)
 
 	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "best")
 
@@ -248,6 +363,8 @@ func initSDL() {
 	mapControllers()
 
 	sdl.ShowCursor(0)
+	// text input is only wanted while the console is open
+	sdl.StopTextInput()
 
 	fps.Init()
 	fps.SetRate(FPS)
@@ -271,75 +388,39 @@ func mapControllers() {
 }
 
 func loadAssets() {
-	font = loadFont("LCD_Solid.ttf", 20)
-	gfx.background = loadImage("background.png")
-	gfx.title = loadImage("title.png")
-	gfx.menu.cursor = loadImage("menu_cursor.png")
-	gfx.player = loadImage("player_ship.png")
-	gfx.health.full = loadImage("health_full.png")
-	gfx.health.empty = loadImage("health_empty.png")
-	gfx.laser.player = loadImage("laser.png")
-	gfx.laser.enemy = loadImage("laser_enemy.png")
-	gfx.enemy = loadImage("enemy_ship.png")
-	gfx.enemy2 = loadImage("enemy_ship2.png")
-	gfx.explosion = loadImage("explosion.png")
-	sfx.music = loadMusic("music1.ogg")
-	sfx.fire.player = loadSound("player_fire.wav")
-	sfx.fire.enemy = loadSound("enemy_fire.wav")
-	sfx.explosion = loadSound("explosion.wav")
-}
-
-func loadFont(name string, ptSize int) *sdlttf.Font {
-	name = filepath.Join(conf.Assets, name)
-	sdl.Log("loading font %v", name)
-	font, err := sdlttf.OpenFont(name, ptSize)
-	ck(err)
-	return font
-}
-
-func loadImage(name string) *Image {
-	name = filepath.Join(conf.Assets, name)
-	sdl.Log("loading image %v", name)
-	rgba, err := imageutil.LoadRGBAFile(name)
+	var err error
+	assets, err = openAssetLoader(conf.Assets)
 	ck(err)
-	rgba = imageutil.ColorKey(rgba, color.RGBA{0xff, 0, 0xff, 0xff})
-	return &Image{
-		RGBA: rgba,
-	}
-}
-
-func loadMusic(name string) *sdlmixer.Music {
-	name = filepath.Join(conf.Assets, name)
-	sdl.Log("loading music %v", name)
-	mus, err := sdlmixer.LoadMUS(name)
-	if ek(err) {
-		return nil
-	}
-	return mus
-}
-
-func loadSound(name string) *sdlmixer.Chunk {
-	name = filepath.Join(conf.Assets, name)
-	sdl.Log("loading sound %v", name)
-	snd, err := sdlmixer.LoadWAV(name)
-	if ek(err) {
-		return nil
-	}
-	return snd
-}
-
-func playMusic(mus *sdlmixer.Music) {
-	if mus != nil && conf.Music {
-		sdlmixer.VolumeMusic(conf.Volume.Music * 10)
-		sdlmixer.FadeInMusic(mus, -1, 500)
-	}
-}
 
-func playSFX(snd *sdlmixer.Chunk) {
-	if snd != nil && conf.Sound {
-		snd.Volume(conf.Volume.Sound * 10)
-		snd.PlayChannel(0, 0)
+	sdl.Log("loading assets from %v", assets.Source)
+	conf.Scoring, conf.Versus = assets.Scoring()
+	font = assets.Font("text")
+	for _, l := range conf.Levels {
+		for _, b := range l.backgroundLayers() {
+			assets.Image(b.Image)
+		}
 	}
+	gfx.title = assets.Image("title")
+	gfx.menu.cursor = assets.Image("cursor")
+	gfx.health.full = assets.Image("health_full")
+	gfx.health.empty = assets.Image("health_empty")
+	gfx.laser.player = assets.Image("laser")
+	gfx.laser.enemy = assets.Image("laser_enemy")
+	atlas = assets.Atlas()
+	tint := color.RGBA{140, 180, 255, 255}
+	atlas.Tint("player2", "player", tint)
+	atlas.Tint("player2_invuln", "player_invuln", tint)
+	emitters = assets.Emitters()
+	sfx.fire.player = assets.Sound("player_fire")
+	sfx.fire.enemy = assets.Sound("enemy_fire")
+	sfx.explosion = assets.Sound("explosion")
+	music.Load(assets)
+	attract.Demos = loadDemos(assets)
+	assets.Finish()
+}
+
+func playSFX(snd *Sound, x, y int) {
+	mixer.Play(snd, x, y)
 }
 
 func collide(a, b sdl.Rect) bool {
@@ -359,51 +440,173 @@ func collide(a, b sdl.Rect) bool {
 }
 
 func reset() {
+	if session != nil {
+		session.Close()
+		session = nil
+	}
+	if spectator != nil {
+		spectator.Close()
+		spectator = nil
+	}
+	if caster != nil {
+		caster.End()
+	}
+	replay = nil
 	menu = Menu{}
 	status = Status{}
 	paused = false
 	run = true
 	state = TITLE
-	sdlmixer.FadeOutMusic(500)
+	setScreenSize(WIDTH, HEIGHT)
 }
 
-func newGame() {
+func newGame(mode, numPlayers int) {
 	state = PLAY
-	playMusic(sfx.music)
-	player = newPlayer()
-	enemies = make([]*Enemy, MAX_ENEMIES)
-	for i := range enemies {
-		enemies[i] = newEnemy()
+
+	seed := time.Now().UnixNano()
+	if nextSeed != 0 {
+		seed, nextSeed = nextSeed, 0
+	}
+	debug.Clear()
+	startWorlds(makeWorlds(mode, numPlayers, seed, inputDevices(numPlayers)))
+	replay = nil
+	if !conf.Invincible {
+		replay = newReplay(mode, numPlayers, seed)
 	}
-	explosions = make([]*Explosion, MAX_EXPLOSIONS)
-	for i := range explosions {
-		explosions[i] = newExplosion()
+	if caster != nil {
+		caster.Start(mode, numPlayers, seed, conf.Rules())
 	}
-	enemySpawnTimer = 180
-	enemyWaves = 0
-	totalEnemies = 0
-	transitionTimer = 10
+}
+
+// checkGame checks a mode and number of players that came from outside the
+// game, such as a replay or a broadcast, are ones makeWorlds can play.
+func checkGame(mode, numPlayers int) error {
+	if numPlayers < 1 || numPlayers > 2 {
+		return fmt.Errorf("%d players", numPlayers)
+	}
+	if mode != MODE_COOP && mode != MODE_VERSUS && mode != MODE_SPLIT {
+		return fmt.Errorf("unknown mode %d", mode)
+	}
+	return nil
+}
+
+// makeWorlds creates the worlds for a new game, split screen versus gives
+// every player a world of their own while the other modes share one.
+func makeWorlds(mode, numPlayers int, seed int64, devices []int) []*World {
+	if mode == MODE_SPLIT {
+		ws := make([]*World, numPlayers)
+		for i := range ws {
+			ws[i] = newWorld(mode, seed, []int{i}, devices[i:i+1])
+		}
+		return ws
+	}
+
+	ids := make([]int, numPlayers)
+	for i := range ids {
+		ids[i] = i
+	}
+	return []*World{newWorld(mode, seed, ids, devices)}
+}
+
+func startWorlds(ws []*World) {
+	worlds = ws
+	views = nil
+	if len(ws) > 1 {
+		setScreenSize(len(ws)*WIDTH, HEIGHT)
+		views = make([]*image.RGBA, len(ws))
+		for i := range views {
+			views[i] = image.NewRGBA(image.Rect(0, 0, WIDTH, HEIGHT))
+		}
+	}
+}
+
+// newNetGame starts a co-op game with a remote player, the world is created
+// once the peer has connected and the seed is known.
+func newNetGame() {
+	if conf.Invincible {
+		ck(fmt.Errorf("invincibility cannot be turned on in netplay games"))
+	}
+
+	var err error
+	if conf.Netplay.Host != "" {
+		session, err = hostNetplay(conf.Netplay.Host, conf.Netplay.Delay)
+	} else {
+		session, err = joinNetplay(conf.Netplay.Join, conf.Netplay.Delay)
+	}
+	ck(err)
+	session.Rules = conf.Rules()
+	if conf.Netplay.Loss > 0 || conf.Netplay.Lag > 0 {
+		session.Link = newLossyLink(session.Link, conf.Netplay.Loss, conf.Netplay.Lag, time.Now().UnixNano())
+	}
+
+	state = PLAY
+	worlds = nil
+	views = nil
+	status.Set("Waiting for the other player | Press 'q' to quit", -1)
+}
+
+// setScreenSize resizes the canvas and the texture it is streamed into,
+// split screen games use a canvas wide enough to hold both worlds side by side.
+func setScreenSize(w, h int) {
+	if r := canvas.Bounds(); r.Dx() == w && r.Dy() == h {
+		return
+	}
+
+	canvas = image.NewRGBA(image.Rect(0, 0, w, h))
+	// replays are rendered without a window
+	if renderer == nil {
+		return
+	}
+
+	texture.Destroy()
+	var err error
+	texture, err = renderer.CreateTexture(sdl.PIXELFORMAT_ABGR8888, sdl.TEXTUREACCESS_STREAMING, w, h)
+	ck(err)
+	renderer.SetLogicalSize(w, h)
 }
 
 func subImage(m *Image, x, y, w, h int) *Image {
-	return &Image{m.SubImage(image.Rect(x, y, x+w, y+h)).(*image.RGBA)}
+	if m == nil {
+		return nil
+	}
+	return &Image{RGBA: m.SubImage(image.Rect(x, y, x+w, y+h)).(*image.RGBA)}
 }
 
-func frameAdvance(frame *int, total int) {
-	if animationTimer == 0 {
-		if *frame++; *frame > total-1 {
-			*frame = 0
+func tintImage(m *Image, c color.RGBA) *Image {
+	if m == nil {
+		return nil
+	}
+	r := m.Bounds()
+	t := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := m.RGBAAt(x, y)
+			p.R = uint8(int(p.R) * int(c.R) / 255)
+			p.G = uint8(int(p.G) * int(c.G) / 255)
+			p.B = uint8(int(p.B) * int(c.B) / 255)
+			t.SetRGBA(x, y, p)
 		}
 	}
+	return &Image{RGBA: t}
 }
 
 func loop() {
 	reset()
+	recorder = newClipRecorder()
+	if conf.Spectate.Watch != "" {
+		watchGame()
+	} else if conf.Netplay.Host != "" || conf.Netplay.Join != "" {
+		newNetGame()
+	}
 	for run {
+		start := time.Now()
 		event()
 		update()
+		music.Update()
 		blit()
+		work := time.Since(start)
 		fps.Delay()
+		debug.Frame(work, time.Since(start))
 	}
 	conf.Save()
 }
@@ -419,9 +622,39 @@ func event() {
 		case sdl.QuitEvent:
 			run = false
 		case sdl.KeyDownEvent:
-			if ev.Sym == sdl.K_ESCAPE {
+			if ev.Sym == sdl.K_BACKQUOTE && !ev.Repeat {
+				console.Toggle()
+				continue
+			}
+			if console.Open {
+				console.Key(ev)
+				continue
+			}
+			switch {
+			case ev.Sym == sdl.K_ESCAPE && state == DEMO:
+				attract.Stop()
+				continue
+			case ev.Sym == sdl.K_ESCAPE:
 				run = false
+			case ev.Sym == sdl.K_F11 && !ev.Repeat:
+				saveRecording()
+			case ev.Sym == sdl.K_F12 && !ev.Repeat:
+				screenshot = true
+			}
+			debug.Key(ev)
+		case sdl.TextInputEvent:
+			if console.Open {
+				console.Text(ev)
+			}
+			continue
+		case sdl.KeyUpEvent:
+			debug.KeyUp(ev)
+			continue
+		case sdl.MouseButtonDownEvent:
+			if debug.On {
+				debug.Click(int(ev.X), int(ev.Y))
 			}
+			continue
 		case sdl.ControllerDeviceAddedEvent:
 			mapControllers()
 			continue
@@ -430,10 +663,16 @@ func event() {
 		key := keyState(ev)
 		switch state {
 		case TITLE:
+			if pressed(ev) {
+				attract.Reset()
+			}
 			evTitle(key)
+		case DEMO:
+			if pressed(ev) {
+				attract.Stop()
+			}
 		case PLAY:
-			action := actionState()
-			evPlay(key, action)
+			evPlay(key)
 		case GAMEOVER:
 			evGameOver(key)
 		}
@@ -455,6 +694,8 @@ func keyState(ev sdl.Event) uint64 {
 			key |= KDD
 		case sdl.K_z, sdl.K_SPACE:
 			key |= KDZ
+		case sdl.K_x:
+			key |= KDB
 		case sdl.K_p, sdl.K_BACKSPACE:
 			key |= KDP
 		case sdl.K_q:
@@ -478,6 +719,8 @@ func keyState(ev sdl.Event) uint64 {
 			key |= KDD
 		case sdl.CONTROLLER_BUTTON_A, sdl.CONTROLLER_BUTTON_B:
 			key |= KDZ
+		case sdl.CONTROLLER_BUTTON_Y:
+			key |= KDB
 		case sdl.CONTROLLER_BUTTON_X:
 			key |= KDI
 		case sdl.CONTROLLER_BUTTON_START:
@@ -490,28 +733,84 @@ func keyState(ev sdl.Event) uint64 {
 	return key
 }
 
-func actionState() uint64 {
-	var action uint64
-	keys := sdl.GetKeyboardState()
-	if keys[sdl.SCANCODE_LEFT] != 0 || keys[sdl.SCANCODE_A] != 0 {
-		action |= KDL
-	}
-	if keys[sdl.SCANCODE_RIGHT] != 0 || keys[sdl.SCANCODE_D] != 0 {
-		action |= KDR
+// inputDevices binds each player to its own input device. A single player
+// reads every device, two players get a controller each if enough are
+// plugged in, and otherwise share the keyboard between them.
+func inputDevices(numPlayers int) []int {
+	if numPlayers == 1 {
+		return []int{INPUT_ANY}
 	}
-	if keys[sdl.SCANCODE_UP] != 0 || keys[sdl.SCANCODE_W] != 0 {
-		action |= KDU
+
+	var pads []int
+	for i, ctl := range ctls {
+		if ctl != nil {
+			pads = append(pads, i)
+		}
 	}
-	if keys[sdl.SCANCODE_DOWN] != 0 || keys[sdl.SCANCODE_S] != 0 {
-		action |= KDD
+
+	switch {
+	case len(pads) >= 2:
+		return pads[:2]
+	case len(pads) == 1:
+		return []int{INPUT_KEYBOARD, pads[0]}
+	default:
+		return []int{INPUT_KEYBOARD_LEFT, INPUT_KEYBOARD_RIGHT}
 	}
-	if keys[sdl.SCANCODE_SPACE] != 0 || keys[sdl.SCANCODE_Z] != 0 {
-		action |= KDZ
+}
+
+func actionState(device int) uint64 {
+	var action uint64
+	keys := sdl.GetKeyboardState()
+	// the keyboard types into the console while it is open
+	left := !console.Open && (device == INPUT_ANY || device == INPUT_KEYBOARD || device == INPUT_KEYBOARD_LEFT)
+	right := !console.Open && (device == INPUT_ANY || device == INPUT_KEYBOARD || device == INPUT_KEYBOARD_RIGHT)
+	if left {
+		if keys[sdl.SCANCODE_A] != 0 {
+			action |= KDL
+		}
+		if keys[sdl.SCANCODE_D] != 0 {
+			action |= KDR
+		}
+		if keys[sdl.SCANCODE_W] != 0 {
+			action |= KDU
+		}
+		if keys[sdl.SCANCODE_S] != 0 {
+			action |= KDD
+		}
+		if keys[sdl.SCANCODE_SPACE] != 0 || keys[sdl.SCANCODE_Z] != 0 {
+			action |= KDZ
+		}
+		if keys[sdl.SCANCODE_X] != 0 {
+			action |= KDB
+		}
+		if keys[sdl.SCANCODE_I] != 0 {
+			action |= KDI
+		}
 	}
-	if keys[sdl.SCANCODE_I] != 0 {
-		action |= KDI
+	if right {
+		if keys[sdl.SCANCODE_LEFT] != 0 {
+			action |= KDL
+		}
+		if keys[sdl.SCANCODE_RIGHT] != 0 {
+			action |= KDR
+		}
+		if keys[sdl.SCANCODE_UP] != 0 {
+			action |= KDU
+		}
+		if keys[sdl.SCANCODE_DOWN] != 0 {
+			action |= KDD
+		}
+		if keys[sdl.SCANCODE_RCTRL] != 0 {
+			action |= KDZ
+		}
+		if keys[sdl.SCANCODE_RSHIFT] != 0 {
+			action |= KDB
+		}
 	}
-	for _, ctl := range ctls {
+	for i, ctl := range ctls {
+		if ctl == nil || (device != INPUT_ANY && device != i) {
+			continue
+		}
 		if ctl.Button(sdl.CONTROLLER_BUTTON_DPAD_UP) != 0 {
 			action |= KDU
 		}
@@ -527,6 +826,9 @@ func actionState() uint64 {
 		if ctl.Button(sdl.CONTROLLER_BUTTON_A) != 0 || ctl.Button(sdl.CONTROLLER_BUTTON_B) != 0 {
 			action |= KDZ
 		}
+		if ctl.Button(sdl.CONTROLLER_BUTTON_Y) != 0 {
+			action |= KDB
+		}
 		if ctl.Button(sdl.CONTROLLER_BUTTON_X) != 0 {
 			action |= KDI
 		}
@@ -552,22 +854,28 @@ func moveMenuSelector(key uint64, max int) {
 func evTitle(key uint64) {
 	switch menu.Level {
 	case 0: // main menu
-		moveMenuSelector(key, 2)
+		moveMenuSelector(key, 5)
 
 		if key&KDZ == 0 {
 			break
 		}
 		switch menu.Selection {
-		case 0: // start
-			newGame()
-		case 1: // options
+		case 0: // 1 player
+			newGame(MODE_COOP, 1)
+		case 1: // 2 players
+			newGame(MODE_COOP, 2)
+		case 2: // versus
+			newGame(MODE_VERSUS, 2)
+		case 3: // split screen versus
+			newGame(MODE_SPLIT, 2)
+		case 4: // options
 			menu.Level = 1
 			menu.Selection = 0
-		case 2: // quit
+		case 5: // quit
 			run = false
 		}
 	case 1: // options
-		moveMenuSelector(key, 5)
+		moveMenuSelector(key, 8)
 		if key&(KDZ|KDL|KDR) == 0 {
 			break
 		}
@@ -598,7 +906,6 @@ func evTitle(key uint64) {
 				conf.Volume.Sound++
 			}
 			conf.Volume.Sound = clamp(conf.Volume.Sound, 0, 12)
-			sdlmixer.Volume(0, conf.Volume.Sound*10)
 		case 4: // music volume
 			if key&KDL != 0 {
 				conf.Volume.Music--
@@ -607,8 +914,23 @@ func evTitle(key uint64) {
 				conf.Volume.Music++
 			}
 			conf.Volume.Music = clamp(conf.Volume.Music, 0, 12)
-			sdlmixer.VolumeMusic(conf.Volume.Music * 10)
-		case 5: // back
+		case 5: // co-op game over rule
+			if key&KRP == 0 {
+				conf.Coop = cyclic(conf.Coop+1, COOP_SHARED, COOP_SPLIT)
+			}
+		case 6: // netplay input delay
+			if key&KDL != 0 {
+				conf.Netplay.Delay--
+			}
+			if key&KDR != 0 {
+				conf.Netplay.Delay++
+			}
+			conf.Netplay.Delay = clamp(conf.Netplay.Delay, 0, 8)
+		case 7: // screen shake, hit-stop and flashes
+			if key&KRP == 0 {
+				conf.Effects.Enabled = !conf.Effects.Enabled
+			}
+		case 8: // back
 			if key&KDZ != 0 {
 				menu.Level = 0
 				menu.Selection = 0
@@ -617,36 +939,36 @@ func evTitle(key uint64) {
 	}
 }
 
-func evPlay(key, action uint64) {
-	if key&KDI != 0 && key&KRP == 0 {
-		conf.Invincible = !conf.Invincible
-		sdl.Log("invincible: %v", toggle(conf.Invincible))
+func evPlay(key uint64) {
+	if key&KDI != 0 && key&KRP == 0 && session == nil {
+		toggleInvincible()
 	}
 
-	if key&KDP != 0 {
+	if key&KDP != 0 && session == nil {
 		paused = !paused
 
 		if paused {
 			status.Set("Game Paused | Press 'q' to quit", -1)
-			sdlmixer.VolumeMusic(conf.Volume.Music / 2 * 10)
 		} else {
 			status.Set("", 0)
-			sdlmixer.VolumeMusic(conf.Volume.Music * 10)
 		}
 	}
 
-	if key&KDQ != 0 && paused {
+	if key&KDQ != 0 && (paused || session != nil || spectator != nil) {
 		reset()
 		return
 	}
+}
 
-	if transitionTimer > 0 {
-		transitionTimer--
+func toggleInvincible() {
+	conf.Invincible = !conf.Invincible
+	sdl.Log("invincible: %v", toggle(conf.Invincible))
+	if conf.Invincible {
+		cheated()
 	}
-
-	player.Action = action
-	if transitionTimer > 0 {
-		player.Action &^= KDZ
+	// spectators have to play by the new rule from this frame on
+	if caster != nil && len(worlds) > 0 {
+		caster.Snapshot(worlds, conf.Rules())
 	}
 }
 
@@ -658,91 +980,263 @@ func evGameOver(key uint64) {
 }
 
 func update() {
-	if paused || state == TITLE {
+	if state == TITLE || state == DEMO {
+		attract.Update()
 		return
 	}
-
-	if state != GAMEOVER {
-		player.InvulnTick()
-		player.Move()
-		player.Fire()
-		testCollisions()
+	if paused {
+		return
 	}
-	spawnEnemies()
-	moveEnemies()
-	enemiesFire()
 
-	moveLasers()
+	switch {
+	case session != nil || spectator != nil:
+		// netplay and spectated games run on a clock shared with the
+		// other side
+		step()
+	case debug.Frozen:
+		debug.Update()
+	default:
+		for timestep += timescale; timestep >= 1; timestep-- {
+			step()
+		}
+	}
 
+	if state != GAMEOVER && gameOver() {
+		state = GAMEOVER
+		if session == nil && spectator == nil {
+			saveReplay()
+			submitScores()
+		}
+	}
 	if state == GAMEOVER {
-		status.Set("Game Over | Press 'q' to continue", -1)
+		status.Set(gameOverText(), -1)
+	}
+	if session != nil && session.Desync >= 0 {
+		status.Set(fmt.Sprintf("Desync at frame %d | Press 'q' to quit", session.Desync), -1)
+	}
+}
+
+// step advances the game by one frame.
+func step() {
+	held := false
+	switch {
+	case spectator != nil:
+		spectator.Update()
+	case session != nil:
+		session.Update(actionState(INPUT_ANY))
+		if worlds == nil && session.Connected {
+			startWorlds([]*World{session.World})
+			status.Set("", 0)
+			if caster != nil {
+				caster.Start(MODE_COOP, 2, session.Seed, session.Rules)
+			}
+		}
+		if caster != nil && worlds != nil {
+			broadcastNetplay()
+		}
+	case holdWorlds():
+		held = true
+	default:
+		inputs := make([][]uint64, len(worlds))
+		for i, w := range worlds {
+			inputs[i] = make([]uint64, len(w.Players))
+			for j, p := range w.Players {
+				inputs[i][j] = actionState(p.Device)
+			}
+			w.Step(inputs[i])
+		}
+		exchangeGarbage(worlds)
+		if caster != nil {
+			broadcastFrame(inputs)
+		}
+		if replay != nil {
+			replay.Record(inputs)
+		}
+		// the frames after the game ended are left out so a rewind from
+		// the game over screen goes straight back into the game
+		if state != GAMEOVER {
+			debug.Record(worlds)
+		}
 	}
 
-	animationTimer = cyclic(animationTimer-1, 0, 2)
+	if atlas != nil {
+		for _, w := range worlds {
+			if !held {
+				w.Animate()
+			}
+			w.animateCamera()
+		}
+	}
+}
+
+func gameOver() bool {
+	if len(worlds) == 0 {
+		return false
+	}
+	for _, w := range worlds {
+		if !w.Over {
+			return false
+		}
+	}
+	return true
+}
+
+func gameOverText() string {
+	if worlds[0].Mode == MODE_COOP {
+		return "Game Over | Press 'q' to continue"
+	}
+
+	var best *Player
+	tie := false
+	for _, w := range worlds {
+		for _, p := range w.Players {
+			if best == nil || p.Score > best.Score {
+				best, tie = p, false
+			} else if p.Score == best.Score {
+				tie = true
+			}
+		}
+	}
+	if tie {
+		return "Draw | Press 'q' to continue"
+	}
+	return fmt.Sprintf("%dP Wins | Press 'q' to continue", best.ID+1)
+}
+
+// exchangeGarbage hands the enemies sent by each split screen player over to
+// the opponent's world.
+func exchangeGarbage(worlds []*World) {
+	if len(worlds) != 2 {
+		return
+	}
+	for i, w := range worlds {
+		o := worlds[1-i]
+		for ; w.Outgoing > 0; w.Outgoing-- {
+			if !o.Over {
+				o.Garbage = append(o.Garbage, 0)
+			}
+		}
+	}
+}
+
+func (w *World) readInput(inputs []uint64) {
+	if w.TransitionTimer > 0 {
+		w.TransitionTimer--
+	}
+
+	for i, p := range w.Players {
+		p.LastAction = p.Action
+		p.Action = inputs[i]
+		if w.TransitionTimer > 0 {
+			p.Action &^= KDZ | KDB
+		}
+	}
+}
+
+func (w *World) testCollisions() {
+	for _, p := range w.Players {
+		w.testPlayerCollisions(p)
+	}
 }
 
-func testCollisions() {
+func (w *World) testPlayerCollisions(player *Player) {
+	if !player.Alive {
+		return
+	}
+
 	for _, l := range player.Lasers {
-		for _, e := range enemies {
-			if !(player.Alive && l.Alive && e.Alive && e.Y+e.H >= 0 && collide(l.Rect, e.Rect)) {
+		for _, e := range w.Enemies {
+			if !(l.Alive && e.Alive && e.Y+e.H >= 0 && collide(l.Rect, e.Rect)) {
 				continue
 			}
-			e.Alive = false
-			totalEnemies--
+			w.removeEnemy(e)
 			l.Alive = false
-			if e.Kind == 0 {
-				player.Score += 50
-			} else if e.Kind == 1 {
-				player.Score += 100
-			}
-			spawnExplosion(int(e.X), int(e.Y))
-			playSFX(sfx.explosion)
+			player.Kill(w, e)
+			w.emit("spark", int(l.X+l.W/2), int(l.Y))
+			w.spawnWreck(e)
+			w.dropPickup(e)
+			playSFX(sfx.explosion, int(e.X+e.W/2), int(e.Y+e.H/2))
 			break
 		}
 	}
 
-	for _, e := range enemies {
+	for _, e := range w.Enemies {
 		for _, l := range e.Lasers {
 			if !(player.Alive && l.Alive && collide(player.Rect, l.Rect)) {
 				continue
 			}
 			if !player.Invuln {
 				l.Alive = false
-				player.Damage(1)
+				l.Grazer = 0
+				w.emit("spark", int(l.X+l.W/2), int(l.Y+l.H))
+				player.Damage(w, 1)
 			}
 			break
 		}
 	}
 
-	for _, e := range enemies {
+	// a laser grazes once it has passed through the graze zone, or died in
+	// it, without hitting the ship
+	graze := player.Rect
+	radius := int32(conf.Scoring.GrazeRadius)
+	graze.X -= radius
+	graze.Y -= radius
+	graze.W += radius * 2
+	graze.H += radius * 2
+	id := player.ID + 1
+	safe := player.Alive && !player.Invuln
+	for _, e := range w.Enemies {
+		for _, l := range e.Lasers {
+			in := safe && l.Alive && collide(graze, l.Rect)
+			switch {
+			case in && l.Grazer == 0 && !l.Grazed:
+				l.Grazer = id
+			case !in && l.Grazer == id:
+				l.Grazer = 0
+				if safe {
+					l.Grazed = true
+					player.Graze(w, l)
+				}
+			}
+		}
+	}
+
+	for _, p := range w.Pickups {
+		if !(p.Alive && player.Alive && collide(p.Rect, player.Rect)) {
+			continue
+		}
+		p.Alive = false
+		if player.Bombs < MAX_BOMBS {
+			player.Bombs++
+		}
+	}
+
+	for _, e := range w.Enemies {
 		if !(e.Alive && player.Alive && collide(e.Rect, player.Rect)) {
 			continue
 		}
 		if !player.Invuln {
-			e.Alive = false
-			totalEnemies--
-			player.Damage(2)
+			w.removeEnemy(e)
+			player.Damage(w, 2)
 		}
 		break
 	}
 }
 
 func blit() {
-	draw.Draw(canvas, canvas.Bounds(), image.Black, image.ZP, draw.Src)
-	blitBackground()
-	switch state {
-	case TITLE:
-		blitTitle()
-	case PLAY:
-		player.Blit()
-		fallthrough
-	case GAMEOVER:
-		blitEnemies()
-		blitExplosions()
-		blitLasers()
-		blitInfo()
-		status.Blit()
+	render()
+	recorder.Capture(canvas)
+	if screenshot {
+		screenshot = false
+		name, err := saveScreenshot()
+		if err != nil {
+			console.Printf("screenshot: %v", err)
+		} else {
+			sdl.Log("saved screenshot %v", name)
+			console.Printf("saved %v", name)
+		}
 	}
+	console.Blit()
 
 	renderer.SetDrawColor(sdlcolor.Black)
 	renderer.Clear()
@@ -751,17 +1245,75 @@ func blit() {
 	renderer.Present()
 }
 
-func blitBackground() {
-	const scrollSpeed = 10
-	if !paused {
-		if background.Y < 640 {
-			background.Y += scrollSpeed
-		} else {
-			background.Y = 0
+// render draws the game into the canvas.
+func render() {
+	draw.Draw(canvas, canvas.Bounds(), image.Black, image.ZP, draw.Src)
+	scrollBackground()
+	switch state {
+	case TITLE:
+		blitBackground()
+		blitTitle()
+	case PLAY, GAMEOVER:
+		blitWorlds()
+		status.Blit()
+	case DEMO:
+		blitWorlds()
+		attract.Blit()
+	}
+}
+
+// blitWorlds draws every world, split screen worlds are each drawn into
+// their own view and then placed side by side on the canvas.
+func blitWorlds() {
+	if len(worlds) == 1 {
+		worlds[0].Blit()
+		if debug.On {
+			debug.Blit(worlds[0], 0)
+		}
+		return
+	}
+
+	screen := canvas
+	for i, w := range worlds {
+		canvas = views[i]
+		w.Blit()
+		if debug.On {
+			debug.Blit(w, i)
 		}
+		draw.Draw(screen, canvas.Bounds().Add(image.Pt(i*WIDTH, 0)), canvas, image.ZP, draw.Src)
 	}
-	gfx.background.Blit(0, background.Y)
-	gfx.background.Blit(0, background.Y-640)
+	canvas = screen
+}
+
+func (w *World) Blit() {
+	blitBackground()
+	if !w.Over {
+		for _, p := range w.Players {
+			p.Blit(w)
+		}
+	}
+	w.blitEnemies()
+	w.blitExplosions()
+	w.blitParticles()
+	w.blitPickups()
+	w.blitLasers()
+	w.blitPopups()
+	w.blitFlash()
+	w.blitShake()
+	w.blitInfo()
+	if status.Timeout == 0 {
+		w.Status.Blit()
+	}
+}
+
+func scrollBackground() {
+	if !paused {
+		background.Update()
+	}
+}
+
+func blitBackground() {
+	background.Blit()
 }
 
 func blitText(x, y int, text string) {
@@ -770,6 +1322,15 @@ func blitText(x, y int, text string) {
 	draw.Draw(canvas, image.Rect(x, y, x+int(r.W), y+int(r.H)), surface, image.ZP, draw.Over)
 }
 
+type coopRule int
+
+func (c coopRule) String() string {
+	if c == COOP_SPLIT {
+		return "split"
+	}
+	return "shared"
+}
+
 type toggle bool
 
 func (t toggle) String() string {
@@ -781,13 +1342,16 @@ func (t toggle) String() string {
 
 func blitTitle() {
 	options := [][]string{
-		{"Start", "Options", "Quit"},
+		{"1 Player", "2 Players", "Versus", "Split Versus", "Options", "Quit"},
 		{
 			fmt.Sprintf("Fullscreen:   %v", toggle(conf.Fullscreen)),
 			fmt.Sprintf("SFX:          %v", toggle(conf.Sound)),
 			fmt.Sprintf("Music:        %v", toggle(conf.Music)),
 			fmt.Sprintf("SFX Volume:   %v", conf.Volume.Sound),
 			fmt.Sprintf("Music Volume: %v", conf.Volume.Music),
+			fmt.Sprintf("Co-op:        %v", coopRule(conf.Coop)),
+			fmt.Sprintf("Input Delay:  %v", conf.Netplay.Delay),
+			fmt.Sprintf("Effects:      %v", toggle(conf.Effects.Enabled)),
 			"Back",
 		},
 	}
@@ -802,35 +1366,68 @@ func blitTitle() {
 	gfx.title.Blit((WIDTH-486)/2, 50)
 }
 
-func blitInfo() {
-	text := fmt.Sprintf("Score: %d", player.Score)
-	blitText(5, 5+BOTTOM, text)
+func (w *World) blitInfo() {
+	if len(w.Players) == 1 {
+		blitPlayerInfo(w.Players[0], 0, WIDTH)
+		return
+	}
+	for i, p := range w.Players {
+		blitPlayerInfo(p, i*WIDTH/len(w.Players), WIDTH/len(w.Players))
+	}
+}
+
+// blitPlayerInfo draws the HUD for one player inside the horizontal strip
+// starting at x that is w pixels wide.
+func blitPlayerInfo(p *Player, x, w int) {
+	text := fmt.Sprintf("Score: %d", p.Score)
+	if len(worlds) > 1 || w < WIDTH {
+		text = fmt.Sprintf("%dP: %d", p.ID+1, p.Score)
+	}
+	blitText(x+5, 5+BOTTOM, text)
+
+	text = fmt.Sprintf("Graze: %d", p.Grazes)
+	blitText(x+5, 5, text)
+	meter := image.Rect(x+5, 28, x+5+p.GrazeMeter, 32)
+	draw.Draw(canvas, image.Rect(x+5, 28, x+5+MAX_GRAZE, 32), image.NewUniform(color.RGBA{64, 64, 64, 255}), image.ZP, draw.Src)
+	draw.Draw(canvas, meter, image.NewUniform(color.RGBA{255, 220, 64, 255}), image.ZP, draw.Src)
 
-	blitText(WIDTH-200, 5+BOTTOM, "Health")
+	text = fmt.Sprintf("Bombs: %d", p.Bombs)
+	blitText(x+w-120, 5, text)
+
+	if p.Chain > 0 {
+		text = fmt.Sprintf("Chain: %d x%d", p.Chain, p.Multiplier())
+		blitText(x+5, 36, text)
+	}
+
+	if w >= WIDTH {
+		blitText(x+w-200, 5+BOTTOM, "Health")
+	}
 
 	for i := 0; i < MAX_HEALTH; i++ {
-		if i < player.Health {
-			gfx.health.full.Blit(WIDTH-120+i*18, 3+BOTTOM)
+		if i < p.Health {
+			gfx.health.full.Blit(x+w-120+i*18, 3+BOTTOM)
 		} else {
-			gfx.health.empty.Blit(WIDTH-120+i*18, 3+BOTTOM)
+			gfx.health.empty.Blit(x+w-120+i*18, 3+BOTTOM)
 		}
 	}
 }
 
-func blitEnemies() {
-	for _, e := range enemies {
-		e.Blit()
+func (w *World) blitEnemies() {
+	for _, e := range w.Enemies {
+		e.Blit(w)
 	}
 }
 
-func blitLasers() {
-	for _, l := range player.Lasers {
-		if l.Alive {
-			l.Blit(int(l.X), int(l.Y))
+func (w *World) blitLasers() {
+	for _, p := range w.Players {
+		for _, l := range p.Lasers {
+			if l.Alive {
+				l.Blit(int(l.X), int(l.Y))
+			}
 		}
 	}
 
-	for _, e := range enemies {
+	for _, e := range w.Enemies {
 		for _, l := range e.Lasers {
 			if l.Alive {
 				l.Blit(int(l.X), int(l.Y))
@@ -839,38 +1436,221 @@ func blitLasers() {
 	}
 }
 
-func blitExplosions() {
-	for _, e := range explosions {
+func (w *World) blitFlash() {
+	if w.FlashTimer > 0 {
+		alpha := uint8(clamp(w.FlashTimer*12, 0, 255))
+		white := image.NewUniform(color.RGBA{alpha, alpha, alpha, alpha})
+		draw.Draw(canvas, image.Rect(0, 0, WIDTH, BOTTOM), white, image.ZP, draw.Over)
+	}
+}
+
+func (w *World) blitPickups() {
+	for _, p := range w.Pickups {
+		if p.Alive {
+			r := image.Rect(int(p.X), int(p.Y), int(p.X+p.W), int(p.Y+p.H))
+			draw.Draw(canvas, r, image.NewUniform(color.RGBA{200, 40, 40, 255}), image.ZP, draw.Src)
+			blitText(int(p.X)+3, int(p.Y)-2, "B")
+		}
+	}
+}
+
+func (w *World) blitPopups() {
+	for _, p := range w.Popups {
+		if p.Alive {
+			blitText(p.X-len(p.Text)*6, p.Y, p.Text)
+		}
+	}
+}
+
+func (w *World) blitExplosions() {
+	for _, e := range w.Explosions {
 		if e.Alive {
-			e.Sheet[e.Frame].Blit(int(e.X), int(e.Y))
-			if e.Frame++; e.Frame >= len(e.Sheet) {
-				e.Alive = false
+			if e.Flash > 0 {
+				e.Wreck.Sprite().BlitFlash(int(e.X), int(e.Y))
 			}
+			e.Anim.Sprite().Blit(int(e.X), int(e.Y))
 		}
 	}
 }
 
 type Config struct {
-	Assets     string `json:"-"`
-	Pref       string `json:"-"`
-	Invincible bool   `json:"-"`
-	Sound      bool
-	Music      bool
-	Fullscreen bool
-	Volume     struct {
-		Sound int
-		Music int
+	Assets       string `json:"-"`
+	Audio        string `json:"-"`
+	Placeholders bool   `json:"-"`
+	Validate     bool   `json:"-"`
+	Pref         string `json:"-"`
+	Invincible   bool   `json:"-"`
+	Sound        bool
+	Music        bool
+	Fullscreen   bool
+	Coop         int
+	Volume       struct {
+		Sound      int
+		Music      int
+		Weapons    int
+		Explosions int
+	}
+	// the scoring and versus rules come from the asset manifest so every
+	// player has the same ones, they are never saved
+	Scoring    Scoring `json:"-"`
+	Versus     Versus  `json:"-"`
+	Levels     []Level
+	Soundtrack struct {
+		Boss     string
+		GameOver string
+		Fade     int
+		Duck     int
+	}
+	Leaderboard struct {
+		URL  string
+		Name string
+	}
+	Particles struct {
+		Budget int
+	}
+	Effects struct {
+		Enabled bool
+		Shake   int
+		HitStop int
+		Flash   int
+	}
+	Attract struct {
+		Idle int
+	}
+	Capture struct {
+		Seconds int
+		FPS     int
+		Scale   int
+		Format  string
+		Replays bool
+		Render  string `json:"-"`
+	}
+	Spectate struct {
+		Broadcast string `json:"-"`
+		Watch     string `json:"-"`
+	}
+	Netplay struct {
+		Host     string `json:"-"`
+		Join     string `json:"-"`
+		Delay    int
+		Loss     int `json:"-"`
+		Lag      int `json:"-"`
+		Loopback int `json:"-"`
+	}
+}
+
+type Scoring struct {
+	Enemies       []ScoreRule
+	ChainWindow   int
+	ChainStep     int
+	MaxMultiplier int
+	Graze         int64
+	GrazeRadius   int
+	GrazeMeter    int
+	BombEvery     int64
+	BombDrop      int
+}
+
+type Versus struct {
+	GarbageChain int
+}
+
+func defaultScoring() Scoring {
+	return Scoring{
+		Enemies: []ScoreRule{
+			{Kill: 50, Escape: 100},
+			{Kill: 100, Escape: 200},
+		},
+		ChainWindow:   90,
+		ChainStep:     4,
+		MaxMultiplier: 8,
+		Graze:         10,
+		GrazeRadius:   16,
+		GrazeMeter:    5,
+		BombEvery:     10000,
+		BombDrop:      5,
 	}
 }
 
+func defaultVersus() Versus {
+	return Versus{GarbageChain: 5}
+}
+
+// ScoreRule describes how many points an enemy type is worth when it is
+// destroyed and how many are lost when it escapes off the bottom of the screen.
+type ScoreRule struct {
+	Kill   int64
+	Escape int64
+}
+
 func (c *Config) Defaults() {
 	c.Assets = filepath.Join(sdl.GetBasePath(), "assets")
 	c.Pref = sdl.GetPrefPath("", "espada")
+	c.Audio = "sdl"
 	c.Sound = true
 	c.Music = true
 	c.Fullscreen = false
+	c.Coop = COOP_SHARED
 	c.Volume.Sound = 6
 	c.Volume.Music = 8
+	c.Volume.Weapons = 12
+	c.Volume.Explosions = 12
+	c.Scoring = defaultScoring()
+	c.Versus = defaultVersus()
+	c.Netplay.Delay = 2
+	c.Leaderboard.Name = "Player"
+	c.Levels = []Level{
+		{Wave: 1, Music: "music1.ogg"},
+	}
+	c.Soundtrack.Fade = 1000
+	c.Soundtrack.Duck = 50
+	c.Particles.Budget = 2048
+	c.Effects.Enabled = true
+	c.Effects.Shake = 8
+	c.Effects.HitStop = 4
+	c.Effects.Flash = 6
+	c.Attract.Idle = 30
+	c.Capture.Seconds = 5
+	c.Capture.FPS = 30
+	c.Capture.Scale = 2
+	c.Capture.Format = "gif"
+	c.Capture.Replays = true
+}
+
+func (c *Config) ScoreRule(kind int) ScoreRule {
+	if 0 <= kind && kind < len(c.Scoring.Enemies) {
+		return c.Scoring.Enemies[kind]
+	}
+	return ScoreRule{}
+}
+
+// Rules are the parts of the config that change how World.Step plays out,
+// games played over the network carry the rules of the side that started
+// them so both sides simulate the same game.
+type Rules struct {
+	Coop         int
+	Scoring      Scoring
+	GarbageChain int
+	Invincible   bool
+}
+
+func (c *Config) Rules() Rules {
+	return Rules{
+		Coop:         c.Coop,
+		Scoring:      c.Scoring,
+		GarbageChain: c.Versus.GarbageChain,
+		Invincible:   c.Invincible,
+	}
+}
+
+// SetRules plays by a set of rules and returns the ones played by before.
+func (c *Config) SetRules(r Rules) Rules {
+	old := c.Rules()
+	c.Coop = r.Coop
+	c.Scoring = r.Scoring
+	c.Versus.GarbageChain = r.GarbageChain
+	c.Invincible = r.Invincible
+	return old
 }
 
 func (c *Config) Load() {
@@ -899,8 +1679,11 @@ func (c *Config) Save() {
 	ek(ioutil.WriteFile(name, buf, 0644))
 }
 
+// Image is a picture that can be drawn on the canvas, Placeholder is set
+// when it stands in for art that did not load.
 type Image struct {
 	*image.RGBA
+	Placeholder bool
 }
 
 func (m *Image) Blit(x, y int) {
@@ -908,48 +1691,278 @@ func (m *Image) Blit(x, y int) {
 	draw.Draw(canvas, image.Rect(int(x), int(y), int(x)+r.Dx(), int(y)+r.Dy()), m.RGBA, r.Min, draw.Over)
 }
 
+// World holds everything that makes up one running game. Split screen
+// versus runs two worlds started from the same seed side by side.
+type World struct {
+	Mode            int
+	Seed            int64
+	Frame           int
+	RNG             RNG
+	Over            bool
+	Players         []*Player
+	Enemies         []*Enemy
+	TotalEnemies    int
+	Explosions      []*Explosion
+	Popups          []*Popup
+	Pickups         []*Pickup
+	Garbage         []int
+	Outgoing        int
+	FlashTimer      int
+	BombTimer       int
+	EnemySpawnTimer int
+	EnemyWaves      int
+	TransitionTimer int
+	Status          Status
+	Particles       *Particles `json:"-"`
+	Camera          *Camera    `json:"-"`
+}
+
+func newWorld(mode int, seed int64, ids, devices []int) *World {
+	w := &World{
+		Mode:            mode,
+		Seed:            seed,
+		EnemySpawnTimer: 180,
+		TransitionTimer: 10,
+	}
+	w.RNG.Seed(seed)
+
+	w.Players = make([]*Player, len(ids))
+	for i := range w.Players {
+		x := int32(295)
+		if len(ids) > 1 {
+			x = int32(WIDTH*(i+1)/(len(ids)+1) - 32)
+		}
+		w.Players[i] = newPlayer(ids[i], devices[i], x)
+	}
+	w.Enemies = make([]*Enemy, MAX_ENEMIES+MAX_GARBAGE)
+	for i := range w.Enemies {
+		w.Enemies[i] = newEnemy()
+	}
+	w.Explosions = make([]*Explosion, MAX_EXPLOSIONS)
+	for i := range w.Explosions {
+		w.Explosions[i] = newExplosion()
+	}
+	w.Popups = make([]*Popup, MAX_POPUPS)
+	for i := range w.Popups {
+		w.Popups[i] = &Popup{}
+	}
+	w.Pickups = make([]*Pickup, MAX_PICKUPS)
+	for i := range w.Pickups {
+		w.Pickups[i] = &Pickup{Rect: sdl.Rect{W: 16, H: 16}}
+	}
+	return w
+}
+
+// Step advances the world by one frame using one input bitmask per player.
+// All randomness comes from the world's own generator, so the same seed and
+// inputs always play out the same way.
+func (w *World) Step(inputs []uint64) {
+	w.Frame++
+	if !w.Over {
+		w.readInput(inputs)
+		for _, p := range w.Players {
+			if !p.Alive {
+				continue
+			}
+			p.InvulnTick()
+			p.ChainTick()
+			p.Move()
+			p.Fire()
+			p.Bomb(w)
+			p.AwardBombs()
+		}
+		w.testCollisions()
+	}
+	w.spawnEnemies()
+	w.spawnGarbage()
+	w.moveEnemies()
+	w.enemiesFire()
+
+	w.moveLasers()
+	w.movePopups()
+	w.movePickups()
+	w.chainBombExplosions()
+
+	if w.FlashTimer > 0 {
+		w.FlashTimer--
+	}
+}
+
+// Clone returns a deep copy of the world that can later be passed to
+// Restore. The images entities draw with are shared, not copied.
+func (w *World) Clone() *World {
+	c := *w
+	c.Players = make([]*Player, len(w.Players))
+	for i, p := range w.Players {
+		q := *p
+		q.Lasers = cloneLasers(p.Lasers)
+		c.Players[i] = &q
+	}
+	c.Enemies = make([]*Enemy, len(w.Enemies))
+	for i, e := range w.Enemies {
+		f := *e
+		f.Lasers = cloneLasers(e.Lasers)
+		c.Enemies[i] = &f
+	}
+	c.Explosions = make([]*Explosion, len(w.Explosions))
+	for i, e := range w.Explosions {
+		f := *e
+		c.Explosions[i] = &f
+	}
+	c.Popups = make([]*Popup, len(w.Popups))
+	for i, p := range w.Popups {
+		q := *p
+		c.Popups[i] = &q
+	}
+	c.Pickups = make([]*Pickup, len(w.Pickups))
+	for i, p := range w.Pickups {
+		q := *p
+		c.Pickups[i] = &q
+	}
+	c.Garbage = append([]int(nil), w.Garbage...)
+	return &c
+}
+
+// attachImages points the lasers of a world decoded from JSON back at the
+// loaded images, which are never serialized. Everything else refers to its
+// animations in the atlas by name.
+func (w *World) attachImages() {
+	for _, p := range w.Players {
+		for _, l := range p.Lasers {
+			l.Image = gfx.laser.player
+		}
+	}
+	for _, e := range w.Enemies {
+		for _, l := range e.Lasers {
+			l.Image = gfx.laser.enemy
+		}
+	}
+}
+
+func cloneLasers(lasers []*Laser) []*Laser {
+	c := make([]*Laser, len(lasers))
+	for i, l := range lasers {
+		m := *l
+		c[i] = &m
+	}
+	return c
+}
+
+// Restore rewinds the world to a state saved with Clone, the saved state is
+// left untouched so it can be restored again.
+func (w *World) Restore(s *World) {
+	*w = *s.Clone()
+}
+
+// Checksum hashes the parts of the world that affect how the game plays out,
+// leaving out purely visual state like animation frames and score popups.
+func (w *World) Checksum() uint32 {
+	h := fnv.New32a()
+	put := func(v ...interface{}) {
+		for _, x := range v {
+			binary.Write(h, binary.LittleEndian, x)
+		}
+	}
+	put(int64(w.Frame), w.RNG.State, w.Over, int64(w.TotalEnemies), int64(w.EnemySpawnTimer), int64(w.EnemyWaves))
+	put(int64(w.TransitionTimer), int64(w.BombTimer), int64(w.Outgoing), int64(len(w.Garbage)))
+	for _, p := range w.Players {
+		put(p.Rect, p.Alive, int64(p.Health), p.Score, p.Action, int64(p.Vx), int64(p.Vy), p.Invuln, p.InvulnTimer)
+		put(int64(p.Chain), int64(p.ChainTimer), int64(p.Grazes), int64(p.GrazeMeter), int64(p.Bombs), p.NextBomb, int64(p.LaserTimer))
+		putLasers(put, p.Lasers)
+	}
+	for _, e := range w.Enemies {
+		put(e.Rect, e.Alive, int64(e.Kind), int64(e.PathLength), int64(e.Dir), e.Garbage, int64(e.Target), int64(e.LaserTimer))
+		putLasers(put, e.Lasers)
+	}
+	for _, p := range w.Pickups {
+		put(p.Rect, p.Alive)
+	}
+	return h.Sum32()
+}
+
+func putLasers(put func(...interface{}), lasers []*Laser) {
+	for _, l := range lasers {
+		put(l.Rect, l.Vx, l.Alive, l.Grazed, int64(l.Grazer))
+	}
+}
+
+func (w *World) randn(a, b int) int {
+	return int(w.RNG.Uint64()%uint64(b-a+1)) + a
+}
+
+// RNG is a xorshift64* generator. Its whole state is one word so that it can
+// be copied along with the rest of a world.
+type RNG struct {
+	State uint64
+}
+
+func (r *RNG) Seed(seed int64) {
+	r.State = uint64(seed)
+	if r.State == 0 {
+		r.State = 0x9E3779B97F4A7C15
+	}
+}
+
+func (r *RNG) Uint64() uint64 {
+	r.State ^= r.State >> 12
+	r.State ^= r.State << 25
+	r.State ^= r.State >> 27
+	return r.State * 2685821657736338717
+}
+
 type Entity struct {
 	sdl.Rect
 	Alive      bool
-	Sheet      [2][2]*Image
-	Frame      int
+	Anim       Anim
 	Lasers     []*Laser
 	LaserTimer int
+	Flash      int `json:",omitempty"`
 }
 
 type Player struct {
 	Entity
+	Skin        string
+	ID          int
+	Device      int
 	Health      int
 	Score       int64
 	Action      uint64
+	LastAction  uint64
 	Vx, Vy      int
 	Invuln      bool
 	InvulnTimer uint32
+	Chain       int
+	ChainTimer  int
+	Grazes      int
+	GrazeMeter  int
+	Bombs       int
+	NextBomb    int64
 }
 
-func newPlayer() *Player {
+func newPlayer(id, device int, x int32) *Player {
+	skin := "player"
+	if id > 0 {
+		skin = "player2"
+	}
+
 	p := &Player{
 		Entity: Entity{
 			Rect: sdl.Rect{
-				X: 295,
+				X: x,
 				Y: BOTTOM - 64,
 				W: 64,
 				H: 64,
 			},
 			Alive:  true,
 			Lasers: make([]*Laser, MAX_LASERS),
-			Sheet: [2][2]*Image{
-				{
-					subImage(gfx.player, 0, 0, 64, 64),
-					subImage(gfx.player, 64, 0, 64, 64),
-				},
-				{
-					subImage(gfx.player, 0, 0, 64, 64),
-					subImage(gfx.player, 64, 64, 64, 64),
-				},
-			},
+			Anim:   Anim{Clip: skin},
 		},
-		Health: MAX_HEALTH,
+		Skin:     skin,
+		ID:       id,
+		Device:   device,
+		Health:   MAX_HEALTH,
+		Bombs:    2,
+		NextBomb: conf.Scoring.BombEvery,
 	}
 	for i := range p.Lasers {
 		p.Lasers[i] = newLaser(gfx.laser.player)
@@ -965,6 +1978,110 @@ func (p *Player) InvulnTick() {
 	}
 }
 
+func (p *Player) ChainTick() {
+	if p.ChainTimer > 0 {
+		if p.ChainTimer--; p.ChainTimer == 0 {
+			p.Chain = 0
+		}
+	}
+}
+
+func (p *Player) Multiplier() int {
+	step := conf.Scoring.ChainStep
+	if step < 1 {
+		step = 1
+	}
+	m := 1 + p.Chain/step
+	if m > conf.Scoring.MaxMultiplier {
+		m = conf.Scoring.MaxMultiplier
+	}
+	if m < 1 {
+		m = 1
+	}
+	return m
+}
+
+// Kill extends the kill chain and awards the enemy's points scaled by the
+// current multiplier, showing the amount where the enemy was destroyed.
+func (p *Player) Kill(w *World, e *Enemy) {
+	p.Chain++
+	p.ChainTimer = conf.Scoring.ChainWindow
+	if n := conf.Versus.GarbageChain; n > 0 && p.Chain%n == 0 {
+		w.sendGarbage(p)
+	}
+
+	points := conf.ScoreRule(e.Kind).Kill * int64(p.Multiplier())
+	p.Score += points
+	w.spawnPopup(int(e.X+e.W/2), int(e.Y+e.H/2), fmt.Sprint(points))
+}
+
+// Graze rewards a bullet that passed close to the ship without hitting it,
+// and fills the graze meter towards a bomb.
+func (p *Player) Graze(w *World, l *Laser) {
+	p.Grazes++
+	p.Score += conf.Scoring.Graze
+	if p.GrazeMeter += conf.Scoring.GrazeMeter; p.GrazeMeter > MAX_GRAZE {
+		p.GrazeMeter = MAX_GRAZE
+	}
+	w.emit("graze", int(l.X+l.W/2), int(l.Y+l.H/2))
+}
+
+// Bomb spends one bomb from the stock, or a full graze meter when the stock
+// is empty, to clear every enemy laser and destroy every enemy on screen,
+// leaving the ship briefly invulnerable.
+func (p *Player) Bomb(w *World) {
+	if p.Action&KDB == 0 || p.LastAction&KDB != 0 {
+		return
+	}
+	switch {
+	case p.Bombs > 0:
+		p.Bombs--
+	case p.GrazeMeter >= MAX_GRAZE:
+		p.GrazeMeter = 0
+	default:
+		return
+	}
+
+	for _, e := range w.Enemies {
+		for _, l := range e.Lasers {
+			l.Alive = false
+			l.Grazer = 0
+		}
+		if !(e.Alive && e.Y+e.H >= 0) {
+			continue
+		}
+		w.removeEnemy(e)
+		p.Kill(w, e)
+		w.spawnWreck(e)
+	}
+
+	p.Invuln = true
+	p.InvulnTimer = 120
+	w.FlashTimer = 20
+	w.BombTimer = 40
+	w.shake(0.8)
+	playSFX(sfx.explosion, int(p.X+p.W/2), int(p.Y))
+}
+
+// AwardBombs adds a bomb to the stock every time the score crosses
+// another multiple of the configured threshold.
+func (p *Player) AwardBombs() {
+	if conf.Scoring.BombEvery <= 0 {
+		return
+	}
+	for p.Score >= p.NextBomb {
+		p.NextBomb += conf.Scoring.BombEvery
+		if p.Bombs < MAX_BOMBS {
+			p.Bombs++
+		}
+	}
+}
+
+func (p *Player) BreakChain() {
+	p.Chain = 0
+	p.ChainTimer = 0
+}
+
 func (p *Player) Move() {
 	const maxSpeed = 8
 
@@ -1035,7 +2152,7 @@ func (p *Player) Fire() {
 				l.X = p.X + p.W/2
 				l.Y = p.Y - l.H
 				p.LaserTimer = 15
-				playSFX(sfx.fire.player)
+				playSFX(sfx.fire.player, int(l.X), int(l.Y))
 				break
 			}
 		}
@@ -1046,63 +2163,65 @@ func (p *Player) Fire() {
 	}
 }
 
-func (p *Player) Blit() {
+func (p *Player) Blit(w *World) {
 	if !p.Alive {
 		return
 	}
 
 	x, y := int(p.X), int(p.Y)
-	if !p.Invuln {
-		p.Sheet[0][p.Frame].Blit(x, y)
-	} else {
-		p.Sheet[1][p.Frame].Blit(x, y)
-
-		r := p.Sheet[1][p.Frame].Bounds()
+	s := p.Anim.Sprite()
+	if p.Flash > 0 {
+		s.BlitFlash(x, y)
+		return
+	}
+	s.Blit(x, y)
+	if p.Invuln {
+		r := s.Bounds()
 		alpha := image.NewUniform(color.RGBA{0, 0, 0, 127})
 		draw.Draw(canvas, image.Rect(x, y, x+r.Dx(), y+r.Dy()), alpha, image.ZP, draw.Over)
 	}
-
-	frameAdvance(&p.Frame, len(p.Sheet[0]))
 }
 
-func (p *Player) Damage(d int) {
+func (p *Player) Damage(w *World, d int) {
 	if conf.Invincible {
 		return
 	}
 
-	player.Invuln = true
-	player.InvulnTimer = 100
-	player.Health -= d
-	playSFX(sfx.explosion)
-
-	if player.Health <= 0 {
-		player.Health = 0
-		player.Alive = false
-		spawnExplosion(int(player.X), int(player.Y))
-		state = GAMEOVER
+	p.Invuln = true
+	p.InvulnTimer = 100
+	p.Health -= d
+	p.BreakChain()
+	playSFX(sfx.explosion, int(p.X+p.W/2), int(p.Y))
+	w.flash(&p.Entity)
+	w.shake(0.3 * float64(d))
+
+	if p.Health <= 0 {
+		p.Health = 0
+		p.Alive = false
+		w.spawnExplosion(int(p.X), int(p.Y))
+		w.shake(1)
+		w.hitStop(conf.Effects.HitStop * 2)
+		if (w.Mode == MODE_COOP && conf.Coop == COOP_SHARED) || w.alivePlayers() == 0 {
+			w.Over = true
+		}
 	}
 }
 
+// enemyClips are the clips of each kind of enemy.
+var enemyClips = [...]string{"enemy", "enemy2"}
+
 type Enemy struct {
 	Entity
 	Kind       int
 	PathLength int
 	Dir        int
+	Garbage    bool
+	Target     int
 }
 
 func newEnemy() *Enemy {
 	e := &Enemy{
 		Entity: Entity{
-			Sheet: [2][2]*Image{
-				{
-					subImage(gfx.player, 0, 0, 64, 32),
-					subImage(gfx.player, 64, 0, 64, 32),
-				},
-				{
-					subImage(gfx.player, 0, 0, 64, 64),
-					subImage(gfx.player, 64, 0, 64, 64),
-				},
-			},
 			Lasers: make([]*Laser, MAX_LASERS),
 		},
 	}
@@ -1112,29 +2231,37 @@ func newEnemy() *Enemy {
 	return e
 }
 
-func (e *Enemy) Blit() {
+func (e *Enemy) Blit(w *World) {
 	if !e.Alive {
 		return
 	}
 
-	x, y := int(e.X), int(e.Y)
-	e.Sheet[e.Kind][e.Frame].Blit(x, y)
-	frameAdvance(&e.Frame, len(e.Sheet[e.Kind]))
+	e.Anim.Sprite().Blit(int(e.X), int(e.Y))
 }
 
-func (e *Enemy) Fire() {
+func (e *Enemy) Fire(w *World) {
 	if e.LaserTimer == 0 && e.Alive && e.Y >= 0 {
 		for _, l := range e.Lasers {
 			if !l.Alive {
 				l.Alive = true
+				l.Grazed = false
+				l.Grazer = 0
 				l.X = e.X + e.W/2
 				l.Y = e.Y + e.H
+				l.Vx = 0
+				if t := w.targetPlayer(e); t != nil {
+					dx := t.X + t.W/2 - l.X
+					dy := t.Y - l.Y
+					if dy > 0 {
+						l.Vx = int32(clamp(int(dx*5/dy), -2, 2))
+					}
+				}
 				if e.Kind == 0 {
-					e.LaserTimer = randn(100, 250)
+					e.LaserTimer = w.randn(100, 250)
 				} else if e.Kind == 1 {
-					e.LaserTimer = randn(50, 100)
+					e.LaserTimer = w.randn(50, 100)
 				}
-				playSFX(sfx.fire.enemy)
+				playSFX(sfx.fire.enemy, int(l.X), int(l.Y))
 				break
 			}
 		}
@@ -1145,7 +2272,36 @@ func (e *Enemy) Fire() {
 	}
 }
 
-func (e *Enemy) Move() bool {
+// targetPlayer picks which of the surviving players an enemy aims at,
+// enemies sent over by an opponent go after the player they were sent to.
+func (w *World) targetPlayer(e *Enemy) *Player {
+	if e.Garbage && w.Players[e.Target].Alive {
+		return w.Players[e.Target]
+	}
+
+	var alive []*Player
+	for _, p := range w.Players {
+		if p.Alive {
+			alive = append(alive, p)
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive[w.randn(0, len(alive)-1)]
+}
+
+func (w *World) alivePlayers() int {
+	n := 0
+	for _, p := range w.Players {
+		if p.Alive {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *Enemy) Move(w *World) bool {
 	if e.Alive {
 		moveSpeed := int32(2)
 		if e.Kind == 1 {
@@ -1153,7 +2309,7 @@ func (e *Enemy) Move() bool {
 		}
 
 		if e.PathLength == 0 {
-			e.PathLength = randn(10, WIDTH/2)
+			e.PathLength = w.randn(10, WIDTH/2)
 		}
 
 		if e.PathLength != 0 {
@@ -1182,18 +2338,19 @@ func (e *Enemy) Move() bool {
 	}
 
 	if e.Y > BOTTOM+e.H {
-		e.Alive = false
-		totalEnemies--
+		w.removeEnemy(e)
 		e.X = 0
 		e.Y = 0
-		if state != GAMEOVER {
-			if e.Kind == 0 {
-				player.Score -= 100
-			} else if e.Kind == 1 {
-				player.Score -= 200
-			}
-			if player.Score < 0 {
-				player.Score = 0
+		if !w.Over {
+			for i, p := range w.Players {
+				if !p.Alive || (e.Garbage && i != e.Target) {
+					continue
+				}
+				p.Score -= conf.ScoreRule(e.Kind).Escape
+				p.BreakChain()
+				if p.Score < 0 {
+					p.Score = 0
+				}
 			}
 			return true
 		}
@@ -1202,65 +2359,119 @@ func (e *Enemy) Move() bool {
 	return false
 }
 
-func spawnEnemies() {
-	if totalEnemies == 0 {
-		if enemySpawnTimer == 0 {
-			for _, e := range enemies {
+func (w *World) removeEnemy(e *Enemy) {
+	e.Alive = false
+	if !e.Garbage {
+		w.TotalEnemies--
+	}
+}
+
+func (w *World) resetEnemy(e *Enemy, kind int) {
+	if kind == 0 {
+		e.W = 64
+		e.H = 32
+	} else {
+		e.W = 64
+		e.H = 64
+	}
+	e.Kind = kind
+	e.Alive = true
+	e.Anim = Anim{Clip: enemyClips[kind]}
+	e.PathLength = 0
+	e.LaserTimer = 0
+	e.Garbage = false
+	e.Target = 0
+	e.Dir = w.randn(0, 1)
+	e.X = int32(w.randn(0, WIDTH-int(e.W)))
+	e.Y = int32(w.randn(-192, -64))
+}
+
+func (w *World) spawnEnemies() {
+	if w.TotalEnemies == 0 {
+		if w.EnemySpawnTimer == 0 {
+			for _, e := range w.Enemies[:MAX_ENEMIES] {
 				if !e.Alive {
-					if enemyWaves < 5 {
-						e.W = 64
-						e.H = 32
-						e.Kind = 0
+					if w.EnemyWaves < 5 {
+						w.resetEnemy(e, 0)
 					} else {
-						e.W = 64
-						e.H = 64
-						e.Kind = 1
+						w.resetEnemy(e, 1)
 					}
-					e.Alive = true
-					e.Frame = 0
-					e.PathLength = 0
-					e.LaserTimer = 0
-					e.Dir = randn(0, 1)
-					e.X = int32(randn(0, WIDTH-int(e.W)))
-					e.Y = int32(randn(-192, -64))
-					totalEnemies++
+					w.TotalEnemies++
 				}
 			}
 		}
 
-		if enemySpawnTimer > 0 {
-			enemySpawnTimer--
+		if w.EnemySpawnTimer > 0 {
+			w.EnemySpawnTimer--
 		}
 	} else {
-		enemySpawnTimer = 180
+		w.EnemySpawnTimer = 180
+	}
+
+	if w.EnemySpawnTimer == 179 && w.TotalEnemies == 0 {
+		if w.EnemyWaves < 1e9 {
+			w.EnemyWaves++
+		}
+		w.Status.Set(fmt.Sprintf("Wave: %d", w.EnemyWaves), 120)
 	}
+}
 
-	if enemySpawnTimer == 179 && totalEnemies == 0 {
-		if enemyWaves < 1e9 {
-			enemyWaves++
+// sendGarbage queues an extra enemy for every opponent of a versus player who
+// chained enough kills. Split screen opponents live in another world, so
+// those are handed over by the caller through Outgoing.
+func (w *World) sendGarbage(from *Player) {
+	switch w.Mode {
+	case MODE_VERSUS:
+		for i, p := range w.Players {
+			if p != from && p.Alive {
+				w.Garbage = append(w.Garbage, i)
+			}
 		}
-		status.Set(fmt.Sprintf("Wave: %d", enemyWaves), 120)
+	case MODE_SPLIT:
+		w.Outgoing++
 	}
 }
 
-func enemiesFire() {
-	for _, e := range enemies {
-		e.Fire()
+// spawnGarbage brings in queued garbage enemies using the spare enemy slots
+// past the regular wave, so they never hold up the next wave.
+func (w *World) spawnGarbage() {
+	for _, e := range w.Enemies[MAX_ENEMIES:] {
+		if len(w.Garbage) == 0 {
+			break
+		}
+		if e.Alive {
+			continue
+		}
+		w.resetEnemy(e, 1)
+		e.Garbage = true
+		e.Target = w.Garbage[0]
+		w.Garbage = w.Garbage[1:]
 	}
 }
 
-func moveEnemies() {
-	for _, e := range enemies {
-		if e.Move() {
+func (w *World) enemiesFire() {
+	for _, e := range w.Enemies {
+		e.Fire(w)
+	}
+}
+
+func (w *World) moveEnemies() {
+	for _, e := range w.Enemies {
+		if e.Move(w) {
 			break
 		}
 	}
 }
 
 type Laser struct {
-	*Image
+	*Image `json:"-"`
 	sdl.Rect
-	Alive bool
+	Vx     int32
+	Alive  bool
+	Grazed bool
+
+	// one more than the ID of the player whose graze zone the laser is in
+	Grazer int
 }
 
 func newLaser(m *Image) *Laser {
@@ -1270,21 +2481,24 @@ func newLaser(m *Image) *Laser {
 	}
 }
 
-func moveLasers() {
+func (w *World) moveLasers() {
 	const moveSpeed = 10
 
-	for _, l := range player.Lasers {
-		if l.Alive {
-			l.Y -= moveSpeed
-		}
-		if l.Y < 0 {
-			l.Alive = false
+	for _, p := range w.Players {
+		for _, l := range p.Lasers {
+			if l.Alive {
+				l.Y -= moveSpeed
+			}
+			if l.Y < 0 {
+				l.Alive = false
+			}
 		}
 	}
 
-	for _, e := range enemies {
+	for _, e := range w.Enemies {
 		for _, l := range e.Lasers {
 			if l.Alive {
+				l.X += l.Vx
 				l.Y += moveSpeed / 2
 			}
 			if l.Y > HEIGHT {
@@ -1296,37 +2510,105 @@ func moveLasers() {
 
 type Explosion struct {
 	sdl.Rect
-	Sheet [8]*Image
-	Frame int
+	Anim  Anim
 	Alive bool
+
+	// the ship that blew up, drawn in white while it flashes
+	Wreck Anim
+	Flash int `json:",omitempty"`
 }
 
 func newExplosion() *Explosion {
-	return &Explosion{
-		Sheet: [8]*Image{
-			subImage(gfx.explosion, 0, 0, 64, 64),
-			subImage(gfx.explosion, 64, 0, 64, 64),
-			subImage(gfx.explosion, 128, 0, 64, 64),
-			subImage(gfx.explosion, 192, 0, 64, 64),
-			subImage(gfx.explosion, 64, 0, 64, 64),
-			subImage(gfx.explosion, 128, 0, 64, 64),
-			subImage(gfx.explosion, 192, 0, 64, 64),
-			subImage(gfx.explosion, 192, 0, 64, 64),
-		},
-	}
+	return &Explosion{}
 }
 
-func spawnExplosion(x, y int) {
-	for _, e := range explosions {
+func (w *World) spawnExplosion(x, y int) *Explosion {
+	for _, e := range w.Explosions {
 		if !e.Alive {
-			e.Alive = true
-			e.Rect = sdl.Rect{int32(x), int32(y), 64, 64}
-			e.Frame = 0
+			*e = Explosion{
+				Rect:  sdl.Rect{int32(x), int32(y), 64, 64},
+				Anim:  Anim{Clip: "explosion"},
+				Alive: true,
+			}
+			w.emit("debris", x+32, y+32)
+			return e
+		}
+	}
+	return nil
+}
+
+type Popup struct {
+	X, Y  int
+	Text  string
+	Timer int
+	Alive bool
+}
+
+func (w *World) spawnPopup(x, y int, text string) {
+	for _, p := range w.Popups {
+		if !p.Alive {
+			p.Alive = true
+			p.X = x
+			p.Y = y
+			p.Text = text
+			p.Timer = 45
+			break
+		}
+	}
+}
+
+func (w *World) movePopups() {
+	for _, p := range w.Popups {
+		if !p.Alive {
+			continue
+		}
+		p.Y--
+		if p.Timer--; p.Timer <= 0 {
+			p.Alive = false
+		}
+	}
+}
+
+func (w *World) chainBombExplosions() {
+	if w.BombTimer == 0 {
+		return
+	}
+	if w.BombTimer%4 == 0 {
+		w.spawnExplosion(w.randn(0, WIDTH-64), w.randn(0, BOTTOM-64))
+	}
+	w.BombTimer--
+}
+
+type Pickup struct {
+	sdl.Rect
+	Alive bool
+}
+
+func (w *World) dropPickup(e *Enemy) {
+	if w.randn(1, 100) > conf.Scoring.BombDrop {
+		return
+	}
+	for _, p := range w.Pickups {
+		if !p.Alive {
+			p.Alive = true
+			p.X = e.X + e.W/2 - p.W/2
+			p.Y = e.Y + e.H/2 - p.H/2
 			break
 		}
 	}
 }
 
+func (w *World) movePickups() {
+	for _, p := range w.Pickups {
+		if !p.Alive {
+			continue
+		}
+		if p.Y += 2; p.Y > BOTTOM {
+			p.Alive = false
+		}
+	}
+}
+
 type Status struct {
 	Text    string
 	Timeout int
@@ -1339,7 +2621,7 @@ func (s *Status) Set(text string, timeout int) {
 
 func (s *Status) Blit() {
 	if s.Timeout != 0 {
-		x := (WIDTH - len(s.Text)*12) / 2
+		x := (canvas.Bounds().Dx() - len(s.Text)*12) / 2
 		blitText(x, 200, s.Text)
 	}
 
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// EXPORT_RATE is the sample rate sounds are mixed at, the same as the
+// audio device is opened with.
+const EXPORT_RATE = 44100
+
+// runExportReplay renders a replay into a numbered PNG sequence and a WAV
+// file of its sound effects that can be put together by a video encoder.
+// The game is drawn with the saved config like it is when playing, and plays
+// by the rules recorded in the replay.
+func runExportReplay(args []string) {
+	fs := flag.NewFlagSet("export-replay", flag.ExitOnError)
+	out := fs.String("o", "export", "output directory")
+	rate := fs.Int("fps", FPS, "frames per second of the PNG sequence")
+	assetsDir := fs.String("assets", "", "assets directory")
+	pref := fs.String("pref", "", "preference directory to load the config from")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *rate < 1 || *rate > FPS {
+		fmt.Fprintf(os.Stderr, "usage: espada export-replay [-o dir] [-fps 1-%d] replay.json\n", FPS)
+		os.Exit(2)
+	}
+
+	conf.Defaults()
+	if *pref != "" {
+		conf.Pref = *pref
+	}
+	conf.Load()
+	if *assetsDir != "" {
+		conf.Assets = *assetsDir
+	}
+	if err := exportReplay(*out, fs.Arg(0), *rate); err != nil {
+		fmt.Fprintf(os.Stderr, "export-replay: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// exportReplay plays a replay back on a clock of its own, every frame of
+// the game takes exactly 1/FPS seconds no matter how long it takes to draw,
+// so the sounds line up with the pictures.
+func exportReplay(dir, file string, rate int) error {
+	r, err := loadReplay(file)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	frame := 0
+	rec := newMixdownAudio(func() int { return frame })
+	initHeadless(rec)
+	loadAssets()
+
+	images := 0
+	var serr error
+	err = playReplay(r, func(n int) {
+		frame = n + 1
+		if frame*rate/FPS <= images || serr != nil {
+			return
+		}
+		serr = savePNG(filepath.Join(dir, fmt.Sprintf("frame%06d.png", images)), canvas)
+		images++
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return serr
+	}
+
+	name := filepath.Join(dir, "audio.wav")
+	if err := rec.Mixdown(name, time.Duration(frame)*time.Second/FPS); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d frames at %d fps and %v of audio into %v\n", images, rate, time.Duration(frame)*time.Second/FPS, dir)
+	return nil
+}
+
+// mixdownAudio records the sounds played like the recording backend and
+// keeps the samples of every sound so they can be mixed into a WAV file.
+// Music is streamed from compressed files and is left out of the mix.
+type mixdownAudio struct {
+	*recordingAudio
+	samples map[string][][2]float64
+}
+
+func newMixdownAudio(frame func() int) *mixdownAudio {
+	return &mixdownAudio{
+		recordingAudio: newRecordingAudio(frame),
+		samples:        make(map[string][][2]float64),
+	}
+}
+
+// LoadSound decodes a WAV file and resamples it to the rate of the mix,
+// pitched variants claim a different rate and come out at their pitch.
+func (a *mixdownAudio) LoadSound(name string, wav []byte) error {
+	s, err := decodeWAV(wav)
+	if err != nil {
+		return err
+	}
+	a.samples[name] = s
+	return a.recordingAudio.LoadSound(name, wav)
+}
+
+// Mixdown mixes every sound played into a 16 bit stereo WAV file of the
+// given length. A sound stops when another one starts on its channel, like
+// it does on the audio device.
+func (a *mixdownAudio) Mixdown(name string, length time.Duration) error {
+	var events []AudioEvent
+	for _, e := range a.Events() {
+		if !e.Music {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Frame < events[j].Frame })
+
+	mix := make([][2]float64, int64(length)*EXPORT_RATE/int64(time.Second))
+	for i, e := range events {
+		start := e.Frame * EXPORT_RATE / FPS
+		end := len(mix)
+		for _, f := range events[i+1:] {
+			if f.Channel == e.Channel {
+				end = f.Frame * EXPORT_RATE / FPS
+				break
+			}
+		}
+
+		s := a.samples[e.Name]
+		v := float64(e.Volume) / 128
+		l, r := v*float64(e.Left)/255, v*float64(e.Right)/255
+		for j := 0; j < len(s) && start+j < end; j++ {
+			mix[start+j][0] += s[j][0] * l
+			mix[start+j][1] += s[j][1] * r
+		}
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	writeWAV(w, mix)
+	err = w.Flush()
+	xerr := f.Close()
+	if err == nil {
+		err = xerr
+	}
+	return err
+}
+
+// decodeWAV reads the samples of an 8 or 16 bit PCM WAV file as stereo at
+// EXPORT_RATE.
+func decodeWAV(buf []byte) ([][2]float64, error) {
+	f, _ := wavFormat(buf)
+	if f < 0 {
+		return nil, errors.New("not a WAV file")
+	}
+	format := binary.LittleEndian.Uint16(buf[f:])
+	channels := int(binary.LittleEndian.Uint16(buf[f+2:]))
+	rate := int(binary.LittleEndian.Uint32(buf[f+4:]))
+	bits := int(binary.LittleEndian.Uint16(buf[f+14:]))
+	if format != 1 || (bits != 8 && bits != 16) || channels < 1 || rate < 1 {
+		return nil, fmt.Errorf("unsupported WAV format %d with %d bits", format, bits)
+	}
+
+	var data []byte
+	for p := 12; p+8 <= len(buf); {
+		n := int(binary.LittleEndian.Uint32(buf[p+4:]))
+		if string(buf[p:p+4]) == "data" {
+			data = buf[p+8:]
+			if n < len(data) {
+				data = data[:n]
+			}
+			break
+		}
+		p += 8 + n + n&1
+	}
+
+	size := channels * bits / 8
+	in := make([][2]float64, len(data)/size)
+	for i := range in {
+		for c := 0; c < 2; c++ {
+			p := data[i*size+(c%channels)*bits/8:]
+			if bits == 8 {
+				in[i][c] = (float64(p[0]) - 128) / 128
+			} else {
+				in[i][c] = float64(int16(binary.LittleEndian.Uint16(p))) / 32768
+			}
+		}
+	}
+	if len(in) == 0 {
+		return in, nil
+	}
+
+	// linear interpolation is what the mixer does when it loads a sound
+	out := make([][2]float64, int64(len(in))*EXPORT_RATE/int64(rate))
+	step := float64(rate) / EXPORT_RATE
+	for i := range out {
+		x := float64(i) * step
+		j := int(x)
+		k := j + 1
+		if k >= len(in) {
+			k = len(in) - 1
+		}
+		t := x - float64(j)
+		for c := 0; c < 2; c++ {
+			out[i][c] = in[j][c]*(1-t) + in[k][c]*t
+		}
+	}
+	return out, nil
+}
+
+// writeWAV writes the samples as a 16 bit stereo WAV file, samples louder
+// than full scale are clipped.
+func writeWAV(w *bufio.Writer, samples [][2]float64) {
+	size := uint32(len(samples) * 4)
+	put16 := func(v uint16) { binary.Write(w, binary.LittleEndian, v) }
+	put32 := func(v uint32) { binary.Write(w, binary.LittleEndian, v) }
+
+	w.WriteString("RIFF")
+	put32(36 + size)
+	w.WriteString("WAVEfmt ")
+	put32(16)
+	put16(1)
+	put16(2)
+	put32(EXPORT_RATE)
+	put32(EXPORT_RATE * 4)
+	put16(4)
+	put16(16)
+	w.WriteString("data")
+	put32(size)
+	for _, s := range samples {
+		for _, v := range s {
+			v = math.Max(-1, math.Min(1, v))
+			put16(uint16(int16(v * 32767)))
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+const (
+	LEADERBOARD_MAX_FRAMES = 60 * 60 * 60
+	LEADERBOARD_MAX_BODY   = 32 << 20
+	LEADERBOARD_TOP        = 10
+)
+
+// Replay is everything needed to play a local game back exactly, the worlds
+// are created from the seed and stepped by the recorded rules with the
+// inputs recorded every frame.
+type Replay struct {
+	Mode    int
+	Players int
+	Rules   Rules
+	Seed    int64
+	Frames  [][][]uint64
+}
+
+func newReplay(mode, numPlayers int, seed int64) *Replay {
+	return &Replay{
+		Mode:    mode,
+		Players: numPlayers,
+		Rules:   conf.Rules(),
+		Seed:    seed,
+	}
+}
+
+// Record stores the inputs of one frame, one slice per world.
+func (r *Replay) Record(inputs [][]uint64) {
+	r.Frames = append(r.Frames, inputs)
+}
+
+// Simulate plays the replay back without a display and returns the worlds
+// as they were on the last recorded frame.
+func (r *Replay) Simulate() ([]*World, error) {
+	if len(r.Frames) > LEADERBOARD_MAX_FRAMES {
+		return nil, fmt.Errorf("replay is too long (%d frames)", len(r.Frames))
+	}
+	p, err := newReplayPlayer(r)
+	if err != nil {
+		return nil, err
+	}
+
+	quiet := silent
+	silent = true
+	defer func() { silent = quiet }()
+
+	for p.Step() {
+	}
+	return p.Worlds, p.Err
+}
+
+// Submission is a score sent to the leaderboard along with the replay of the
+// game it was scored in.
+type Submission struct {
+	Name   string
+	Player int
+	Score  int64
+	Replay *Replay
+}
+
+// Verify checks the replay was played by the rules of the leaderboard, then
+// re-simulates it and checks the game ended with the player holding the
+// claimed score.
+func (s *Submission) Verify() error {
+	if s.Replay == nil {
+		return errors.New("submission has no replay")
+	}
+	if err := checkRules(s.Replay.Rules, conf.Rules()); err != nil {
+		return err
+	}
+	ws, err := s.Replay.Simulate()
+	if err != nil {
+		return err
+	}
+	for _, w := range ws {
+		if !w.Over {
+			return errors.New("replay ends before the game is over")
+		}
+	}
+	for _, w := range ws {
+		for _, p := range w.Players {
+			if p.ID != s.Player {
+				continue
+			}
+			if p.Score != s.Score {
+				return fmt.Errorf("claimed score %d but replay scored %d", s.Score, p.Score)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("replay has no player %d", s.Player+1)
+}
+
+// checkRules checks a game was played by the allowed rules, players can
+// pick either co-op rule but everything else has to match.
+func checkRules(r, allowed Rules) error {
+	switch {
+	case r.Coop != COOP_SHARED && r.Coop != COOP_SPLIT:
+		return fmt.Errorf("replay has unknown co-op rule %d", r.Coop)
+	case r.Invincible:
+		return errors.New("replay was played invincible")
+	case !reflect.DeepEqual(r.Scoring, allowed.Scoring):
+		return errors.New("replay was played with different scoring rules")
+	case r.GarbageChain != allowed.GarbageChain:
+		return errors.New("replay was played with different versus rules")
+	}
+	return nil
+}
+
+type Entry struct {
+	Name    string
+	Score   int64
+	Mode    int
+	Players int
+	Frames  int
+	Time    time.Time
+}
+
+// Leaderboard is where finished games are sent, the server verifies every
+// submission before it shows up in the top scores.
+type Leaderboard interface {
+	Submit(s *Submission) error
+	Top(mode, n int) ([]Entry, error)
+}
+
+type httpLeaderboard struct {
+	URL    string
+	Client *http.Client
+}
+
+func newHTTPLeaderboard(url string) *httpLeaderboard {
+	return &httpLeaderboard{
+		URL:    strings.TrimSuffix(url, "/"),
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (l *httpLeaderboard) Submit(s *Submission) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	resp, err := l.Client.Post(l.URL+"/scores", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("leaderboard: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (l *httpLeaderboard) Top(mode, n int) ([]Entry, error) {
+	resp, err := l.Client.Get(fmt.Sprintf("%s/scores?mode=%d&n=%d", l.URL, mode, n))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leaderboard: %s", resp.Status)
+	}
+	var entries []Entry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	return entries, err
+}
+
+// submitScores sends the score of every player in a finished local game to
+// the leaderboard in the background.
+func submitScores() {
+	if board == nil || replay == nil {
+		return
+	}
+	name := conf.Leaderboard.Name
+	for _, w := range worlds {
+		for _, p := range w.Players {
+			s := &Submission{
+				Name:   name,
+				Player: p.ID,
+				Score:  p.Score,
+				Replay: replay,
+			}
+			if replay.Players > 1 {
+				s.Name = fmt.Sprintf("%s %dP", name, p.ID+1)
+			}
+			go func() {
+				if !ek(board.Submit(s)) {
+					sdl.Log("leaderboard: submitted %v with %d points", s.Name, s.Score)
+				}
+			}()
+		}
+	}
+	replay = nil
+}
+
+// FileStore keeps the leaderboard entries in a JSON file, the whole file is
+// rewritten on every new entry.
+type FileStore struct {
+	Name    string
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func openFileStore(name string) (*FileStore, error) {
+	f := &FileStore{Name: name}
+	buf, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &f.entries)
+	return f, err
+}
+
+func (f *FileStore) Add(e Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.entries = append(f.entries, e)
+	sort.SliceStable(f.entries, func(i, j int) bool {
+		return f.entries[i].Score > f.entries[j].Score
+	})
+
+	buf, err := json.MarshalIndent(f.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Name)
+}
+
+func (f *FileStore) Top(mode, n int) []Entry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries := []Entry{}
+	for _, e := range f.entries {
+		if len(entries) >= n {
+			break
+		}
+		if e.Mode == mode {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+type leaderboardServer struct {
+	store *FileStore
+
+	// simulations share the global config, so verify one at a time
+	mu sync.Mutex
+}
+
+func (l *leaderboardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/scores" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		mode, _ := strconv.Atoi(r.FormValue("mode"))
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n <= 0 {
+			n = LEADERBOARD_TOP
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.store.Top(mode, n))
+
+	case "POST":
+		var s Submission
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, LEADERBOARD_MAX_BODY)).Decode(&s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Name = strings.TrimSpace(s.Name)
+		if s.Name == "" || len(s.Name) > 32 {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+
+		l.mu.Lock()
+		err = s.Verify()
+		l.mu.Unlock()
+		if err != nil {
+			sdl.Log("leaderboard: rejected %v from %v: %v", s.Name, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		err = l.store.Add(Entry{
+			Name:    s.Name,
+			Score:   s.Score,
+			Mode:    s.Replay.Mode,
+			Players: s.Replay.Players,
+			Frames:  len(s.Replay.Frames),
+			Time:    time.Now().UTC(),
+		})
+		if ek(err) {
+			http.Error(w, "failed to store score", http.StatusInternalServerError)
+			return
+		}
+		sdl.Log("leaderboard: accepted %v with %d points", s.Name, s.Score)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runLeaderboardServer is the reference leaderboard, it verifies every score
+// against the rules in the asset manifest and keeps them in a file.
+func runLeaderboardServer(args []string) {
+	fs := flag.NewFlagSet("leaderboard-server", flag.ExitOnError)
+	addr := fs.String("addr", ":7200", "listen address")
+	file := fs.String("file", "scores.json", "file to store scores in")
+	assetsDir := fs.String("assets", "", "assets directory to read the scoring rules from")
+	fs.Parse(args)
+
+	conf.Defaults()
+	if *assetsDir != "" {
+		conf.Assets = *assetsDir
+	}
+	l, err := openAssetLoader(conf.Assets)
+	ck(err)
+	conf.Scoring, conf.Versus = l.Scoring()
+	for _, err := range l.Errors {
+		sdl.Log("leaderboard: %v", err)
+	}
+	store, err := openFileStore(*file)
+	ck(err)
+
+	sdl.Log("leaderboard: listening on %v, storing scores in %v", *addr, *file)
+	ck(http.ListenAndServe(*addr, &leaderboardServer{store: store}))
+}
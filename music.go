@@ -0,0 +1,152 @@
+package main
+
+// Level is a range of waves that starts at Wave and lasts until the next
+// level, BossWave is the wave of the level that plays the boss theme.
+// Background lists the layers of its background drawn over an optional
+// Starfield, and Scroll and BossScroll scale how fast they scroll during the
+// level and its boss wave.
+type Level struct {
+	Wave       int
+	Music      string
+	BossWave   int
+	Background []Layer    `json:",omitempty"`
+	Starfield  *Starfield `json:",omitempty"`
+	Scroll     float64    `json:",omitempty"`
+	BossScroll float64    `json:",omitempty"`
+}
+
+// currentLevel returns the level the furthest world has reached, its index
+// in the config and whether its boss wave is on.
+func currentLevel() (Level, int, bool) {
+	if len(conf.Levels) == 0 {
+		return Level{}, -1, false
+	}
+
+	wave := 1
+	for _, w := range worlds {
+		if w.EnemyWaves > wave {
+			wave = w.EnemyWaves
+		}
+	}
+	n := 0
+	for i, l := range conf.Levels {
+		if l.Wave <= wave {
+			n = i
+		}
+	}
+	l := conf.Levels[n]
+	return l, n, l.BossWave == wave
+}
+
+// Director picks the music for what is going on in the game. The mixer plays
+// one track at a time so tracks cannot be crossfaded, they are switched by
+// fading the current one out to silence before the next one fades in. The
+// volume is ducked while the game is paused or a message is shown.
+type Director struct {
+	tracks  map[string]bool
+	playing string
+	target  string
+	loops   int
+	wait    int
+	volume  int
+}
+
+func (d *Director) Load(l *AssetLoader) {
+	d.tracks = make(map[string]bool)
+	for _, name := range musicTracks(l.Manifest) {
+		d.tracks[name] = l.Music(name)
+	}
+	d.volume = -1
+}
+
+func (d *Director) Update() {
+	d.duck()
+
+	name, loops := d.track()
+	if !d.tracks[name] {
+		name = ""
+	}
+	if name == d.target {
+		if d.wait > 0 {
+			if d.wait--; d.wait == 0 {
+				d.start()
+			}
+		}
+		return
+	}
+
+	d.target, d.loops = name, loops
+	if d.playing == "" {
+		d.start()
+		return
+	}
+	audio.StopMusic(conf.Soundtrack.Fade)
+	d.wait = conf.Soundtrack.Fade*FPS/1000 + 1
+}
+
+func (d *Director) start() {
+	d.wait = 0
+	d.playing = d.target
+	if d.playing != "" {
+		audio.PlayMusic(d.playing, d.loops, conf.Soundtrack.Fade)
+	}
+}
+
+// track returns the music that should be playing and how many times to play
+// it, the game over jingle plays once and everything else loops.
+func (d *Director) track() (name string, loops int) {
+	if !conf.Music || state == TITLE || state == DEMO {
+		return "", 0
+	}
+	if state == GAMEOVER {
+		return conf.Soundtrack.GameOver, 1
+	}
+	l, _, boss := currentLevel()
+	if boss && conf.Soundtrack.Boss != "" {
+		return conf.Soundtrack.Boss, -1
+	}
+	return l.Music, -1
+}
+
+// duck moves the music volume a little every frame towards the volume it
+// should have, so ducking does not cut in abruptly.
+func (d *Director) duck() {
+	v := conf.Volume.Music * 10
+	if d.ducked() {
+		v = v * conf.Soundtrack.Duck / 100
+	}
+	if d.volume < 0 {
+		d.volume = v
+	} else if d.volume < v {
+		d.volume += 4
+		if d.volume > v {
+			d.volume = v
+		}
+	} else if d.volume > v {
+		d.volume -= 4
+		if d.volume < v {
+			d.volume = v
+		}
+	} else {
+		return
+	}
+	audio.MusicVolume(d.volume)
+}
+
+func (d *Director) ducked() bool {
+	if paused {
+		return true
+	}
+	if state != PLAY {
+		return false
+	}
+	if status.Timeout != 0 {
+		return true
+	}
+	for _, w := range worlds {
+		if w.Status.Timeout != 0 {
+			return true
+		}
+	}
+	return false
+}
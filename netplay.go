@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+const (
+	NET_RING      = 128
+	NET_MAX_AHEAD = 8
+	NET_MAX_SEND  = 64
+)
+
+const (
+	NET_HELLO = iota
+	NET_INPUT
+)
+
+// Netplay runs a two player co-op game against a remote peer using rollback.
+// Local input is applied after a fixed delay and the remote input is predicted
+// by repeating the last one received; when a prediction turns out wrong the
+// world is restored to the last saved state and simulated forward again.
+// The host picks the seed and the rules, they are sent to the peer until it
+// has joined and both sides play by them for the whole session. Every state
+// that can no longer be rolled back is checksummed, and the checksums are
+// sent like the inputs until the peer acknowledges them.
+type Netplay struct {
+	Link      Link
+	Local     int
+	Delay     int
+	Seed      int64
+	Rules     Rules
+	World     *World
+	Connected bool
+	Desync    int
+
+	inputs     [2][NET_RING]uint64
+	frames     [2][NET_RING]int
+	used       [NET_RING]uint64
+	states     [NET_RING]*World
+	latest     int
+	remote     int
+	peerAck    int
+	rollback   int
+	checkFrame int
+	sums       [NET_RING]uint32
+	peerSums   map[int]uint32
+	sumAck     int
+	peerSumAck int
+}
+
+type netHeader struct {
+	Kind     uint8
+	Frame    int32
+	Ack      int32
+	Seed     int64
+	Start    int32
+	Count    uint8
+	SumAck   int32
+	SumStart int32
+	SumCount uint8
+}
+
+func newNetplay(link Link, local, delay int, seed int64) *Netplay {
+	n := &Netplay{
+		Link:     link,
+		Local:    local,
+		Delay:    delay,
+		Seed:     seed,
+		Desync:   -1,
+		latest:   -1,
+		remote:   -1,
+		peerAck:  -1,
+		rollback: -1,
+		peerSums: make(map[int]uint32),
+	}
+	for i := range n.frames {
+		for j := range n.frames[i] {
+			n.frames[i][j] = -1
+		}
+	}
+	for f := 0; f < delay; f++ {
+		n.setLocal(f, 0)
+	}
+	return n
+}
+
+// hostNetplay listens on addr and waits for a peer to join, the host always
+// plays as the first player and picks the seed.
+func hostNetplay(addr string, delay int) (*Netplay, error) {
+	link, err := listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newNetplay(link, 0, delay, time.Now().UnixNano()), nil
+}
+
+func joinNetplay(addr string, delay int) (*Netplay, error) {
+	link, err := dialUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newNetplay(link, 1, delay, 0), nil
+}
+
+func (n *Netplay) Close() {
+	n.Link.Close()
+}
+
+// Update polls the network, corrects any misprediction, and advances the world
+// by one frame with the given local input unless it is too far ahead of the
+// peer, in which case it waits for the peer to catch up.
+func (n *Netplay) Update(input uint64) {
+	old := conf.SetRules(n.Rules)
+	defer conf.SetRules(old)
+	n.poll()
+	if n.Connected {
+		n.resimulate()
+		if n.World.Frame-n.remote <= NET_MAX_AHEAD {
+			n.setLocal(n.World.Frame+n.Delay, input)
+			n.advance()
+		}
+		n.verify()
+	}
+	n.send()
+}
+
+// Idle exchanges inputs and checksums without advancing the world.
+func (n *Netplay) Idle() {
+	old := conf.SetRules(n.Rules)
+	defer conf.SetRules(old)
+	n.poll()
+	if n.Connected {
+		n.resimulate()
+		n.verify()
+	}
+	n.send()
+}
+
+func (n *Netplay) connect(seed int64) {
+	n.Seed = seed
+	n.Connected = true
+	n.World = makeWorlds(MODE_COOP, 2, seed, []int{INPUT_ANY, INPUT_ANY})[0]
+	sdl.Log("netplay: connected as player %d, seed %d", n.Local+1, seed)
+}
+
+// Confirmed returns the last frame for which the inputs of both players are
+// known, states up to the one after it can no longer be rolled back.
+func (n *Netplay) Confirmed() int {
+	return n.remote
+}
+
+// Inputs returns the inputs both players made on a confirmed frame.
+func (n *Netplay) Inputs(frame int) []uint64 {
+	return []uint64{
+		n.inputs[0][frame%NET_RING],
+		n.inputs[1][frame%NET_RING],
+	}
+}
+
+// State returns the saved state of the world at the start of a recent frame.
+func (n *Netplay) State(frame int) *World {
+	if frame == n.World.Frame {
+		return n.World
+	}
+	return n.states[frame%NET_RING]
+}
+
+func (n *Netplay) known(player, frame int) bool {
+	return frame >= 0 && n.frames[player][frame%NET_RING] == frame
+}
+
+func (n *Netplay) setLocal(frame int, input uint64) {
+	n.inputs[n.Local][frame%NET_RING] = input
+	n.frames[n.Local][frame%NET_RING] = frame
+	n.latest = frame
+}
+
+func (n *Netplay) setRemote(frame int, input uint64) {
+	r := 1 - n.Local
+	if frame <= n.remote || frame > n.remote+NET_RING/2 || n.known(r, frame) {
+		return
+	}
+	n.inputs[r][frame%NET_RING] = input
+	n.frames[r][frame%NET_RING] = frame
+	if n.World != nil && frame < n.World.Frame && n.used[frame%NET_RING] != input {
+		if n.rollback < 0 || frame < n.rollback {
+			n.rollback = frame
+		}
+	}
+	for n.known(r, n.remote+1) {
+		n.remote++
+	}
+}
+
+func (n *Netplay) inputsFor(frame int) []uint64 {
+	r := 1 - n.Local
+	inputs := make([]uint64, 2)
+	inputs[n.Local] = n.inputs[n.Local][frame%NET_RING]
+	if n.known(r, frame) {
+		inputs[r] = n.inputs[r][frame%NET_RING]
+	} else if n.remote >= 0 {
+		inputs[r] = n.inputs[r][n.remote%NET_RING]
+	}
+	n.used[frame%NET_RING] = inputs[r]
+	return inputs
+}
+
+func (n *Netplay) advance() {
+	f := n.World.Frame
+	n.states[f%NET_RING] = n.World.Clone()
+	n.World.Step(n.inputsFor(f))
+}
+
+func (n *Netplay) resimulate() {
+	if n.rollback < 0 {
+		return
+	}
+
+	target := n.World.Frame
+	n.World.Restore(n.states[n.rollback%NET_RING])
+	silent = true
+	for n.World.Frame < target {
+		n.advance()
+	}
+	silent = false
+	n.rollback = -1
+}
+
+// verify checksums every state that can no longer be rolled back and
+// compares them against the ones the peer reported.
+func (n *Netplay) verify() {
+	final := n.remote + 1
+	if final > n.World.Frame {
+		final = n.World.Frame
+	}
+	for n.checkFrame < final {
+		n.checkFrame++
+		w := n.World
+		if n.checkFrame < n.World.Frame {
+			w = n.states[n.checkFrame%NET_RING]
+		}
+		n.sums[n.checkFrame%NET_RING] = w.Checksum()
+		n.compare(n.checkFrame)
+	}
+}
+
+// compare checks the checksum of a frame once both sides have one, frames
+// too old to still have a local checksum are not checked.
+func (n *Netplay) compare(frame int) {
+	remote, ok := n.peerSums[frame]
+	if !ok || frame > n.checkFrame {
+		return
+	}
+	delete(n.peerSums, frame)
+	if frame <= n.checkFrame-NET_RING {
+		return
+	}
+	local := n.sums[frame%NET_RING]
+	if local != remote && n.Desync < 0 {
+		n.Desync = frame
+		sdl.Log("netplay: desync at frame %d (local %#x, remote %#x)", frame, local, remote)
+	}
+}
+
+func (n *Netplay) poll() {
+	for {
+		buf := n.Link.Recv()
+		if buf == nil {
+			break
+		}
+
+		var h netHeader
+		r := bytes.NewReader(buf)
+		if binary.Read(r, binary.LittleEndian, &h) != nil {
+			continue
+		}
+		inputs := make([]uint32, h.Count)
+		if binary.Read(r, binary.LittleEndian, inputs) != nil {
+			continue
+		}
+		sums := make([]uint32, h.SumCount)
+		if binary.Read(r, binary.LittleEndian, sums) != nil {
+			continue
+		}
+
+		if !n.Connected {
+			if n.Local == 0 && h.Kind == NET_HELLO {
+				n.connect(n.Seed)
+			} else if n.Local == 1 && h.Kind == NET_INPUT {
+				// the rules follow the inputs until the peer has joined
+				var rules Rules
+				if json.NewDecoder(r).Decode(&rules) != nil {
+					continue
+				}
+				n.Rules = rules
+				conf.SetRules(rules)
+				n.connect(h.Seed)
+			} else {
+				continue
+			}
+		}
+		if h.Kind != NET_INPUT {
+			continue
+		}
+
+		if int(h.Ack) > n.peerAck {
+			n.peerAck = int(h.Ack)
+		}
+		if int(h.SumAck) > n.peerSumAck {
+			n.peerSumAck = int(h.SumAck)
+		}
+		for i, input := range inputs {
+			n.setRemote(int(h.Start)+i, uint64(input))
+		}
+		for i, sum := range sums {
+			f := int(h.SumStart) + i
+			if f <= n.sumAck {
+				continue
+			}
+			n.sumAck = f
+			n.peerSums[f] = sum
+			n.compare(f)
+		}
+	}
+}
+
+func (n *Netplay) send() {
+	h := netHeader{
+		Kind:   NET_HELLO,
+		Ack:    int32(n.remote),
+		Seed:   n.Seed,
+		SumAck: int32(n.sumAck),
+	}
+	var inputs, sums []uint32
+	if n.Connected {
+		h.Kind = NET_INPUT
+		h.Frame = int32(n.World.Frame)
+		h.Start = int32(n.peerAck + 1)
+		for f := n.peerAck + 1; f <= n.latest && len(inputs) < NET_MAX_SEND; f++ {
+			inputs = append(inputs, uint32(n.inputs[n.Local][f%NET_RING]))
+		}
+		h.Count = uint8(len(inputs))
+
+		// checksums that fell out of the ring are skipped
+		start := n.peerSumAck + 1
+		if start <= n.checkFrame-NET_RING {
+			start = n.checkFrame - NET_RING + 1
+		}
+		h.SumStart = int32(start)
+		for f := start; f <= n.checkFrame && len(sums) < NET_MAX_SEND; f++ {
+			sums = append(sums, n.sums[f%NET_RING])
+		}
+		h.SumCount = uint8(len(sums))
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &h)
+	binary.Write(buf, binary.LittleEndian, inputs)
+	binary.Write(buf, binary.LittleEndian, sums)
+	if n.Local == 0 && n.Connected && n.peerAck < 0 {
+		json.NewEncoder(buf).Encode(n.Rules)
+	}
+	n.Link.Send(buf.Bytes())
+}
+
+// Link is an unreliable datagram connection to the peer.
+type Link interface {
+	Send(buf []byte)
+	Recv() []byte
+	Close()
+}
+
+type udpPacket struct {
+	buf  []byte
+	addr *net.UDPAddr
+}
+
+type udpLink struct {
+	conn  *net.UDPConn
+	peer  *net.UDPAddr
+	queue chan udpPacket
+}
+
+func listenUDP(addr string) (*udpLink, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPLink(conn, nil), nil
+}
+
+func dialUDP(addr string) (*udpLink, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPLink(conn, raddr), nil
+}
+
+func newUDPLink(conn *net.UDPConn, peer *net.UDPAddr) *udpLink {
+	l := &udpLink{
+		conn:  conn,
+		peer:  peer,
+		queue: make(chan udpPacket, 256),
+	}
+	go l.read()
+	return l
+}
+
+func (l *udpLink) read() {
+	for {
+		buf := make([]byte, 1500)
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			close(l.queue)
+			return
+		}
+		select {
+		case l.queue <- udpPacket{buf[:n], addr}:
+		default:
+		}
+	}
+}
+
+func (l *udpLink) Send(buf []byte) {
+	if l.peer != nil {
+		l.conn.WriteToUDP(buf, l.peer)
+	}
+}
+
+// Recv returns the next pending packet, the first sender heard from becomes
+// the peer when listening and packets from anyone else are ignored.
+func (l *udpLink) Recv() []byte {
+	for {
+		select {
+		case p, ok := <-l.queue:
+			if !ok {
+				return nil
+			}
+			if l.peer == nil {
+				l.peer = p.addr
+			}
+			if p.addr.String() != l.peer.String() {
+				continue
+			}
+			return p.buf
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *udpLink) Close() {
+	l.conn.Close()
+}
+
+// pipeLink is one end of an in-memory link between two sessions in the same
+// process.
+type pipeLink struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newPipe() (*pipeLink, *pipeLink) {
+	a := make(chan []byte, 1024)
+	b := make(chan []byte, 1024)
+	return &pipeLink{a, b}, &pipeLink{b, a}
+}
+
+func (l *pipeLink) Send(buf []byte) {
+	select {
+	case l.out <- append([]byte(nil), buf...):
+	default:
+	}
+}
+
+func (l *pipeLink) Recv() []byte {
+	select {
+	case buf := <-l.in:
+		return buf
+	default:
+		return nil
+	}
+}
+
+func (l *pipeLink) Close() {}
+
+// lossyLink simulates a bad connection on top of another link by dropping a
+// percentage of packets and holding the rest back for up to Lag sends, which
+// also reorders them. Sessions send once per frame, so Lag is roughly in frames.
+type lossyLink struct {
+	Link
+	Loss    int
+	Lag     int
+	rng     *rand.Rand
+	sends   int
+	pending []lossyPacket
+}
+
+type lossyPacket struct {
+	due int
+	buf []byte
+}
+
+func newLossyLink(link Link, loss, lag int, seed int64) *lossyLink {
+	return &lossyLink{
+		Link: link,
+		Loss: loss,
+		Lag:  lag,
+		rng:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (l *lossyLink) Send(buf []byte) {
+	l.sends++
+	if l.rng.Intn(100) >= l.Loss {
+		due := l.sends
+		if l.Lag > 0 {
+			due += l.rng.Intn(l.Lag + 1)
+		}
+		l.pending = append(l.pending, lossyPacket{due, append([]byte(nil), buf...)})
+	}
+
+	pending := l.pending[:0]
+	for _, p := range l.pending {
+		if p.due <= l.sends {
+			l.Link.Send(p.buf)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	l.pending = pending
+}
+
+// runLoopback plays two sessions against each other in this process over a
+// lossy in-memory link and reports whether they stayed in sync.
+func runLoopback(frames, loss, lag, delay int) bool {
+	a, b := newPipe()
+	host := newNetplay(newLossyLink(a, loss, lag, 1), 0, delay, time.Now().UnixNano())
+	host.Rules = conf.Rules()
+	join := newNetplay(newLossyLink(b, loss, lag, 2), 1, delay, 0)
+
+	ok := playLoopback(host, join, frames)
+	fmt.Printf("netplay loopback: %d frames, %d%% loss, %d lag, %d delay: ", frames, loss, lag, delay)
+	if ok {
+		fmt.Printf("in sync (checksum %#x)\n", host.World.Checksum())
+	} else {
+		fmt.Printf("DESYNC (host %d, join %d)\n", host.Desync, join.Desync)
+	}
+	return ok
+}
+
+// playLoopback drives two connected sessions with pseudo-random input for a
+// number of frames and reports whether they ended up in the same state.
+func playLoopback(host, join *Netplay, frames int) bool {
+	const mask = KDL | KDR | KDU | KDD | KDZ | KDB
+	rng := rand.New(rand.NewSource(host.Seed))
+	var inputs [2]uint64
+	for i := 0; ; i++ {
+		if i > frames*100 {
+			sdl.Log("netplay loopback: sessions stopped making progress")
+			return false
+		}
+		if i%10 == 0 {
+			inputs[0] = uint64(rng.Intn(mask+1)) & mask
+			inputs[1] = uint64(rng.Intn(mask+1)) & mask
+		}
+
+		for j, n := range []*Netplay{host, join} {
+			if n.World == nil || n.World.Frame < frames {
+				n.Update(inputs[j])
+			} else {
+				n.Idle()
+			}
+		}
+
+		if host.World != nil && join.World != nil &&
+			host.World.Frame >= frames && join.World.Frame >= frames &&
+			host.remote >= frames-1 && join.remote >= frames-1 {
+			break
+		}
+	}
+	host.Idle()
+	join.Idle()
+
+	return host.Desync < 0 && join.Desync < 0 &&
+		host.World.Frame == join.World.Frame && host.World.Checksum() == join.World.Checksum()
+}
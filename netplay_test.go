@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestNetplayLossyLink(t *testing.T) {
+	conf.Defaults()
+	tests := []struct {
+		loss, lag, delay int
+	}{
+		{0, 0, 0},
+		{0, 0, 2},
+		{10, 2, 2},
+		{25, 4, 1},
+		{40, 8, 4},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("loss%d-lag%d-delay%d", tt.loss, tt.lag, tt.delay), func(t *testing.T) {
+			a, b := newPipe()
+			host := newNetplay(newLossyLink(a, tt.loss, tt.lag, 1), 0, tt.delay, 42)
+			host.Rules = conf.Rules()
+			join := newNetplay(newLossyLink(b, tt.loss, tt.lag, 2), 1, tt.delay, 0)
+
+			if !playLoopback(host, join, 600) {
+				t.Fatalf("desync: host %d, join %d", host.Desync, join.Desync)
+			}
+			if host.Desync >= 0 || join.Desync >= 0 {
+				t.Errorf("desync reported: host %d, join %d", host.Desync, join.Desync)
+			}
+			if h, j := host.World.Checksum(), join.World.Checksum(); h != j {
+				t.Errorf("checksums differ: host %#x, join %#x", h, j)
+			}
+		})
+	}
+}
+
+func TestNetplayHostRules(t *testing.T) {
+	conf.Defaults()
+	rules := conf.Rules()
+	rules.Coop = COOP_SPLIT
+	rules.Scoring.Graze = 50
+	rules.Scoring.Enemies = []ScoreRule{{Kill: 7, Escape: 3}, {Kill: 11, Escape: 5}}
+	rules.GarbageChain = 2
+
+	a, b := newPipe()
+	host := newNetplay(newLossyLink(a, 10, 2, 1), 0, 2, 42)
+	host.Rules = rules
+	join := newNetplay(newLossyLink(b, 10, 2, 2), 1, 2, 0)
+
+	if !playLoopback(host, join, 600) {
+		t.Fatalf("desync: host %d, join %d", host.Desync, join.Desync)
+	}
+	if !reflect.DeepEqual(join.Rules, rules) {
+		t.Errorf("joiner plays by %+v, expected %+v", join.Rules, rules)
+	}
+	var def Config
+	def.Defaults()
+	if !reflect.DeepEqual(conf.Rules(), def.Rules()) {
+		t.Errorf("the session rules leaked into the config")
+	}
+}
+
+func TestNetplayDesync(t *testing.T) {
+	conf.Defaults()
+	a, b := newPipe()
+	host := newNetplay(newLossyLink(a, 25, 4, 1), 0, 2, 42)
+	host.Rules = conf.Rules()
+	join := newNetplay(newLossyLink(b, 25, 4, 2), 1, 2, 0)
+
+	changed := -1
+	for i := 0; i < 1000; i++ {
+		host.Update(0)
+		join.Update(0)
+		if changed < 0 && join.World != nil && join.World.Frame >= 100 && join.rollback < 0 {
+			join.World.Players[0].Score++
+			changed = join.World.Frame
+		}
+	}
+	if host.Desync < changed || host.Desync > changed+1 {
+		t.Errorf("host found the desync at frame %d, the joiner changed frame %d", host.Desync, changed)
+	}
+	if join.Desync < changed || join.Desync > changed+1 {
+		t.Errorf("joiner found the desync at frame %d, it changed frame %d", join.Desync, changed)
+	}
+}
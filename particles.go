@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+)
+
+// EmitterDef describes how an emitter throws out particles. Bursts throw
+// out Count particles at once while continuous emitters throw out Rate
+// particles every frame. Angles are in degrees with 0 to the right and 90
+// down the screen, and particles fade from the first color and size to the
+// second over their life. Max limits how many particles of the emitter can
+// be alive at once.
+type EmitterDef struct {
+	Count   int     `json:",omitempty"`
+	Rate    float64 `json:",omitempty"`
+	Life    [2]int
+	Speed   [2]float64
+	Angle   float64
+	Spread  float64
+	Gravity float64 `json:",omitempty"`
+	Drag    float64 `json:",omitempty"`
+	Size    [2]float64
+	Colors  [2]color.RGBA
+	Max     int `json:",omitempty"`
+}
+
+func defaultEmitters() map[string]EmitterDef {
+	return map[string]EmitterDef{
+		"exhaust": {
+			Rate:   2,
+			Life:   [2]int{8, 16},
+			Speed:  [2]float64{2, 4},
+			Angle:  90,
+			Spread: 20,
+			Size:   [2]float64{4, 1},
+			Colors: [2]color.RGBA{{0xff, 0xe0, 0x60, 0xff}, {0xff, 0x30, 0x00, 0x00}},
+			Max:    128,
+		},
+		"spark": {
+			Count:  10,
+			Life:   [2]int{6, 14},
+			Speed:  [2]float64{2, 5},
+			Spread: 360,
+			Drag:   0.9,
+			Size:   [2]float64{2, 1},
+			Colors: [2]color.RGBA{{0xff, 0xff, 0xff, 0xff}, {0xff, 0xc0, 0x20, 0x00}},
+			Max:    256,
+		},
+		"graze": {
+			Count:  4,
+			Life:   [2]int{4, 8},
+			Speed:  [2]float64{1, 2},
+			Spread: 360,
+			Drag:   0.8,
+			Size:   [2]float64{3, 1},
+			Colors: [2]color.RGBA{{0xff, 0xdc, 0x40, 0xff}, {0xff, 0xdc, 0x40, 0x00}},
+			Max:    64,
+		},
+		"debris": {
+			Count:   18,
+			Life:    [2]int{30, 60},
+			Speed:   [2]float64{1, 4},
+			Spread:  360,
+			Gravity: 0.08,
+			Drag:    0.98,
+			Size:    [2]float64{3, 2},
+			Colors:  [2]color.RGBA{{0xc0, 0xc0, 0xc8, 0xff}, {0x40, 0x40, 0x48, 0x00}},
+			Max:     512,
+		},
+		"smoke": {
+			Rate:   0.5,
+			Life:   [2]int{30, 60},
+			Speed:  [2]float64{0.5, 1.5},
+			Angle:  90,
+			Spread: 40,
+			Drag:   0.97,
+			Size:   [2]float64{3, 10},
+			Colors: [2]color.RGBA{{0x80, 0x80, 0x80, 0xa0}, {0x30, 0x30, 0x30, 0x00}},
+			Max:    256,
+		},
+	}
+}
+
+type Particle struct {
+	X, Y   float64
+	Vx, Vy float64
+	Age    int
+	Life   int
+	def    *EmitterDef
+}
+
+// Particles are the particles of one world. They only ever get drawn so they
+// are shared with clones of the world rather than copied, are left out of
+// checksums and snapshots, and use their own random numbers rather than the
+// world's.
+type Particles struct {
+	parts []Particle
+	live  map[*EmitterDef]int
+}
+
+// emit throws out the particles of an emitter at x, y. Nothing is emitted
+// while the game is being resimulated or when nothing is drawn.
+func (w *World) emit(name string, x, y int) {
+	if silent || atlas == nil {
+		return
+	}
+	def := emitters[name]
+	if def == nil {
+		return
+	}
+	n := def.Count
+	if def.Rate > 0 {
+		n = int(def.Rate)
+		if rand.Float64() < def.Rate-float64(n) {
+			n++
+		}
+	}
+	if w.Particles == nil {
+		w.Particles = &Particles{live: make(map[*EmitterDef]int)}
+	}
+	w.Particles.Emit(def, float64(x), float64(y), n)
+}
+
+func (ps *Particles) Emit(def *EmitterDef, x, y float64, n int) {
+	for i := 0; i < n; i++ {
+		if len(ps.parts) >= conf.Particles.Budget || (def.Max > 0 && ps.live[def] >= def.Max) {
+			return
+		}
+
+		a := (def.Angle + (rand.Float64()-0.5)*def.Spread) * math.Pi / 180
+		s := def.Speed[0] + rand.Float64()*(def.Speed[1]-def.Speed[0])
+		life := def.Life[0]
+		if def.Life[1] > def.Life[0] {
+			life += rand.Intn(def.Life[1] - def.Life[0] + 1)
+		}
+		ps.parts = append(ps.parts, Particle{
+			X:    x,
+			Y:    y,
+			Vx:   s * math.Cos(a),
+			Vy:   s * math.Sin(a),
+			Life: life,
+			def:  def,
+		})
+		ps.live[def]++
+	}
+}
+
+// Update moves the particles and drops the ones that died, dead particles
+// are swapped with the last one so the slice stays packed.
+func (ps *Particles) Update() {
+	for i := 0; i < len(ps.parts); {
+		p := &ps.parts[i]
+		if p.Age++; p.Age >= p.Life {
+			ps.live[p.def]--
+			ps.parts[i] = ps.parts[len(ps.parts)-1]
+			ps.parts = ps.parts[:len(ps.parts)-1]
+			continue
+		}
+		if p.def.Drag > 0 {
+			p.Vx *= p.def.Drag
+			p.Vy *= p.def.Drag
+		}
+		p.Vy += p.def.Gravity
+		p.X += p.Vx
+		p.Y += p.Vy
+		i++
+	}
+}
+
+func (ps *Particles) Blit() {
+	for i := range ps.parts {
+		p := &ps.parts[i]
+		t := float64(p.Age) / float64(p.Life)
+		s := p.def.Size[0] + (p.def.Size[1]-p.def.Size[0])*t
+		c0, c1 := p.def.Colors[0], p.def.Colors[1]
+		c := color.NRGBA{
+			R: lerp8(c0.R, c1.R, t),
+			G: lerp8(c0.G, c1.G, t),
+			B: lerp8(c0.B, c1.B, t),
+			A: lerp8(c0.A, c1.A, t),
+		}
+
+		x, y := int(p.X-s/2), int(p.Y-s/2)
+		n := int(s + 0.5)
+		if n < 1 {
+			n = 1
+		}
+		draw.Draw(canvas, image.Rect(x, y, x+n, y+n), image.NewUniform(c), image.ZP, draw.Over)
+	}
+}
+
+func checkEmitter(def EmitterDef) error {
+	switch {
+	case def.Count <= 0 && def.Rate <= 0:
+		return fmt.Errorf("needs a count or a rate")
+	case def.Life[0] <= 0 || def.Life[1] < def.Life[0]:
+		return fmt.Errorf("invalid life %v", def.Life)
+	case def.Speed[1] < def.Speed[0]:
+		return fmt.Errorf("invalid speed %v", def.Speed)
+	case def.Size[0] < 0 || def.Size[1] < 0:
+		return fmt.Errorf("invalid size %v", def.Size)
+	}
+	return nil
+}
+
+func lerp8(a, b uint8, t float64) uint8 {
+	return uint8(float64(a) + (float64(b)-float64(a))*t)
+}
+
+// animateParticles runs the continuous emitters and moves the particles of
+// a world. Ships leave exhaust behind them and smoke once they are badly
+// damaged.
+func (w *World) animateParticles() {
+	if !w.Over {
+		for _, p := range w.Players {
+			if !p.Alive {
+				continue
+			}
+			w.emit("exhaust", int(p.X+p.W/2), int(p.Y+p.H-8))
+			if p.Health <= 2 {
+				w.emit("smoke", int(p.X+p.W/2), int(p.Y+p.H/2))
+			}
+		}
+	}
+	if w.Particles != nil {
+		w.Particles.Update()
+	}
+}
+
+func (w *World) blitParticles() {
+	if w.Particles != nil {
+		w.Particles.Blit()
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+// ReplayPlayer plays a replay back one frame at a time, the worlds can be
+// drawn between frames.
+type ReplayPlayer struct {
+	Replay *Replay
+	Worlds []*World
+	Frame  int
+	Err    error
+}
+
+func newReplayPlayer(r *Replay) (*ReplayPlayer, error) {
+	if err := checkGame(r.Mode, r.Players); err != nil {
+		return nil, fmt.Errorf("replay has %v", err)
+	}
+
+	devices := make([]int, r.Players)
+	for i := range devices {
+		devices[i] = INPUT_ANY
+	}
+	return &ReplayPlayer{
+		Replay: r,
+		Worlds: makeWorlds(r.Mode, r.Players, r.Seed, devices),
+	}, nil
+}
+
+// Step plays the next frame and reports whether there was one. The rules the
+// replay was recorded with are used while it steps.
+func (p *ReplayPlayer) Step() bool {
+	if p.Err != nil || p.Frame >= len(p.Replay.Frames) {
+		return false
+	}
+
+	inputs := p.Replay.Frames[p.Frame]
+	if len(inputs) != len(p.Worlds) {
+		p.Err = fmt.Errorf("replay frame %d has input for %d worlds, expected %d", p.Frame, len(inputs), len(p.Worlds))
+		return false
+	}
+	for j, w := range p.Worlds {
+		if len(inputs[j]) != len(w.Players) {
+			p.Err = fmt.Errorf("replay frame %d has input for %d players, expected %d", p.Frame, len(inputs[j]), len(w.Players))
+			return false
+		}
+	}
+
+	rules := conf.SetRules(p.Replay.Rules)
+	for j, w := range p.Worlds {
+		w.Step(inputs[j])
+	}
+	exchangeGarbage(p.Worlds)
+	conf.SetRules(rules)
+
+	p.Frame++
+	return true
+}
+
+func loadReplay(name string) (*Replay, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decodeReplay(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return r, nil
+}
+
+// decodeReplay reads a replay and checks that it can be played back.
+func decodeReplay(buf []byte) (*Replay, error) {
+	r := new(Replay)
+	if err := json.Unmarshal(buf, r); err != nil {
+		return nil, err
+	}
+	if _, err := newReplayPlayer(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// saveReplay keeps the replay of a finished game in the replays directory
+// of the pref directory.
+func saveReplay() {
+	if replay == nil || !conf.Capture.Replays {
+		return
+	}
+
+	dir := filepath.Join(conf.Pref, "replays")
+	if ek(os.MkdirAll(dir, 0755)) {
+		return
+	}
+	buf, err := json.Marshal(replay)
+	if ek(err) {
+		return
+	}
+	name := filepath.Join(dir, time.Now().Format("espada-20060102-150405.json"))
+	if !ek(ioutil.WriteFile(name, buf, 0644)) {
+		sdl.Log("saved replay %v", name)
+	}
+}
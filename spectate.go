@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/qeedquan/go-media/sdl"
+)
+
+const SPECTATE_INTERVAL = 300
+
+const (
+	SPECTATE_START = iota
+	SPECTATE_SNAPSHOT
+	SPECTATE_INPUT
+	SPECTATE_END
+)
+
+// spectateMsg is one line of the stream sent to spectators. A game starts
+// with the seed and rules, then every frame sends the inputs of all players,
+// and every SPECTATE_INTERVAL frames the whole state is sent so that
+// spectators who join late do not have to replay the game from the
+// beginning. The state is also sent along with the rules whenever the rules
+// change during the game.
+type spectateMsg struct {
+	Kind    int
+	Frame   int             `json:",omitempty"`
+	Mode    int             `json:",omitempty"`
+	Players int             `json:",omitempty"`
+	Seed    int64           `json:",omitempty"`
+	Rules   *Rules          `json:",omitempty"`
+	Worlds  json.RawMessage `json:",omitempty"`
+	Inputs  [][]uint64      `json:",omitempty"`
+}
+
+// Broadcast publishes the games played on this instance to any spectator
+// that connects over TCP.
+type Broadcast struct {
+	ln       net.Listener
+	frame    int
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+	catchup  []spectateMsg
+}
+
+type watcher struct {
+	conn net.Conn
+	out  chan spectateMsg
+}
+
+func newBroadcast(addr string) (*Broadcast, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broadcast{
+		ln:       ln,
+		watchers: make(map[*watcher]bool),
+	}
+	go b.accept()
+	return b, nil
+}
+
+func (b *Broadcast) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		sdl.Log("spectate: %v is watching", conn.RemoteAddr())
+
+		w := &watcher{
+			conn: conn,
+			out:  make(chan spectateMsg, 4*SPECTATE_INTERVAL),
+		}
+		b.mu.Lock()
+		for _, m := range b.catchup {
+			w.out <- m
+		}
+		b.watchers[w] = true
+		b.mu.Unlock()
+		go w.write()
+	}
+}
+
+func (w *watcher) write() {
+	enc := json.NewEncoder(w.conn)
+	for m := range w.out {
+		if enc.Encode(m) != nil {
+			break
+		}
+	}
+	w.conn.Close()
+}
+
+// publish sends a message to every spectator, spectators that fall too far
+// behind are disconnected. A restart drops everything a late joiner would
+// have needed before this message.
+func (b *Broadcast) publish(m spectateMsg, restart bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if restart {
+		b.catchup = nil
+	}
+	b.catchup = append(b.catchup, m)
+	for w := range b.watchers {
+		select {
+		case w.out <- m:
+		default:
+			delete(b.watchers, w)
+			close(w.out)
+		}
+	}
+}
+
+func (b *Broadcast) Start(mode, numPlayers int, seed int64, rules Rules) {
+	b.frame = 0
+	b.publish(spectateMsg{
+		Kind:    SPECTATE_START,
+		Mode:    mode,
+		Players: numPlayers,
+		Seed:    seed,
+		Rules:   &rules,
+	}, true)
+}
+
+func (b *Broadcast) Frame(frame int, inputs [][]uint64) {
+	b.frame = frame + 1
+	b.publish(spectateMsg{
+		Kind:   SPECTATE_INPUT,
+		Frame:  frame,
+		Inputs: inputs,
+	}, false)
+}
+
+func (b *Broadcast) Snapshot(ws []*World, rules Rules) {
+	buf, err := json.Marshal(ws)
+	if ek(err) {
+		return
+	}
+	b.publish(spectateMsg{
+		Kind:   SPECTATE_SNAPSHOT,
+		Frame:  ws[0].Frame,
+		Rules:  &rules,
+		Worlds: buf,
+	}, true)
+}
+
+func (b *Broadcast) End() {
+	b.publish(spectateMsg{Kind: SPECTATE_END}, true)
+}
+
+func broadcastFrame(inputs [][]uint64) {
+	caster.Frame(worlds[0].Frame-1, inputs)
+	if worlds[0].Frame%SPECTATE_INTERVAL == 0 {
+		caster.Snapshot(worlds, conf.Rules())
+	}
+}
+
+// broadcastNetplay publishes the netplay frames that can no longer be rolled
+// back, so spectators never see a mispredicted input.
+func broadcastNetplay() {
+	for caster.frame <= session.Confirmed() && caster.frame < session.World.Frame {
+		f := caster.frame
+		caster.Frame(f, [][]uint64{session.Inputs(f)})
+		if (f+1)%SPECTATE_INTERVAL == 0 {
+			caster.Snapshot([]*World{session.State(f + 1)}, session.Rules)
+		}
+	}
+}
+
+// Spectator watches a game broadcast by another instance by simulating it
+// locally from the received inputs, by the rules the game is played by. A
+// message that cannot be played ends the broadcast with Err set.
+type Spectator struct {
+	conn   net.Conn
+	msgs   chan spectateMsg
+	closed bool
+	rules  Rules
+	Err    error
+}
+
+func watchGame() {
+	conn, err := net.Dial("tcp", conf.Spectate.Watch)
+	ck(err)
+
+	spectator = &Spectator{
+		conn: conn,
+		msgs: make(chan spectateMsg, 4*SPECTATE_INTERVAL),
+	}
+	go spectator.read()
+
+	state = PLAY
+	worlds = nil
+	views = nil
+	status.Set("Waiting for the game to start | Press 'q' to quit", -1)
+}
+
+func (s *Spectator) read() {
+	dec := json.NewDecoder(s.conn)
+	for {
+		var m spectateMsg
+		if dec.Decode(&m) != nil {
+			close(s.msgs)
+			return
+		}
+		s.msgs <- m
+	}
+}
+
+func (s *Spectator) Close() {
+	s.conn.Close()
+}
+
+// Update applies every message received since the last frame, catching up
+// as fast as possible when it is behind.
+func (s *Spectator) Update() {
+	if s.Err != nil {
+		return
+	}
+	old := conf.SetRules(s.rules)
+	defer conf.SetRules(old)
+	for {
+		select {
+		case m, ok := <-s.msgs:
+			if !ok {
+				if !s.closed {
+					s.closed = true
+					status.Set("Broadcast ended | Press 'q' to quit", -1)
+				}
+				return
+			}
+			if err := s.apply(m); err != nil {
+				s.fail(err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Spectator) fail(err error) {
+	s.Err = err
+	s.closed = true
+	s.conn.Close()
+	sdl.Log("spectate: %v", err)
+	status.Set("Broadcast is broken | Press 'q' to quit", -1)
+}
+
+func (s *Spectator) apply(m spectateMsg) error {
+	if m.Rules != nil {
+		s.rules = *m.Rules
+		conf.SetRules(s.rules)
+	}
+
+	switch m.Kind {
+	case SPECTATE_START:
+		if err := checkGame(m.Mode, m.Players); err != nil {
+			return fmt.Errorf("game has %v", err)
+		}
+		devices := make([]int, m.Players)
+		for i := range devices {
+			devices[i] = INPUT_ANY
+		}
+		startWorlds(makeWorlds(m.Mode, m.Players, m.Seed, devices))
+		state = PLAY
+		status.Set("", 0)
+
+	case SPECTATE_SNAPSHOT:
+		var ws []*World
+		if err := json.Unmarshal(m.Worlds, &ws); err != nil {
+			return fmt.Errorf("snapshot: %v", err)
+		}
+		if err := checkSnapshot(ws); err != nil {
+			return fmt.Errorf("snapshot: %v", err)
+		}
+		for _, w := range ws {
+			w.attachImages()
+		}
+		if len(worlds) == 0 {
+			status.Set("", 0)
+		}
+		startWorlds(ws)
+		state = PLAY
+
+	case SPECTATE_INPUT:
+		if len(worlds) == 0 || worlds[0].Frame != m.Frame {
+			return nil
+		}
+		if len(m.Inputs) != len(worlds) {
+			return fmt.Errorf("frame %d has input for %d worlds, expected %d", m.Frame, len(m.Inputs), len(worlds))
+		}
+		for i, w := range worlds {
+			if len(m.Inputs[i]) != len(w.Players) {
+				return fmt.Errorf("frame %d has input for %d players, expected %d", m.Frame, len(m.Inputs[i]), len(w.Players))
+			}
+		}
+		for i, w := range worlds {
+			w.Step(m.Inputs[i])
+		}
+		exchangeGarbage(worlds)
+
+	case SPECTATE_END:
+		worlds = nil
+		views = nil
+		state = PLAY
+		setScreenSize(WIDTH, HEIGHT)
+		status.Set("Waiting for the next game | Press 'q' to quit", -1)
+	}
+	return nil
+}
+
+// checkSnapshot checks the worlds of a snapshot have everything a world
+// needs to be stepped.
+func checkSnapshot(ws []*World) error {
+	if len(ws) < 1 || len(ws) > 2 {
+		return fmt.Errorf("%d worlds", len(ws))
+	}
+	for _, w := range ws {
+		if w == nil || len(w.Players) < 1 || len(w.Players) > 2 {
+			return errors.New("world without players")
+		}
+		for _, p := range w.Players {
+			if p == nil || !lasersSet(p.Lasers) {
+				return errors.New("missing player or laser")
+			}
+		}
+		for _, e := range w.Enemies {
+			if e == nil || !lasersSet(e.Lasers) {
+				return errors.New("missing enemy or laser")
+			}
+		}
+		for _, e := range w.Explosions {
+			if e == nil {
+				return errors.New("missing explosion")
+			}
+		}
+		for _, p := range w.Popups {
+			if p == nil {
+				return errors.New("missing popup")
+			}
+		}
+		for _, p := range w.Pickups {
+			if p == nil {
+				return errors.New("missing pickup")
+			}
+		}
+	}
+	return nil
+}
+
+func lasersSet(ls []*Laser) bool {
+	for _, l := range ls {
+		if l == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// spectate feeds a stream to a spectator and applies it until the stream
+// ends or the spectator gives up on it.
+func spectate(t *testing.T, stream []byte) *Spectator {
+	conf.Defaults()
+	defer func() { worlds, views = nil, nil }()
+
+	a, b := net.Pipe()
+	s := &Spectator{
+		conn:  b,
+		msgs:  make(chan spectateMsg, 4*SPECTATE_INTERVAL),
+		rules: conf.Rules(),
+	}
+	go s.read()
+	go func() {
+		a.Write(stream)
+		a.Close()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.closed {
+		if time.Now().After(deadline) {
+			t.Fatal("the stream never ended")
+		}
+		s.Update()
+		time.Sleep(time.Millisecond)
+	}
+	return s
+}
+
+func spectateStream(msgs ...spectateMsg) []byte {
+	var buf []byte
+	for _, m := range msgs {
+		b, _ := json.Marshal(m)
+		buf = append(append(buf, b...), '\n')
+	}
+	return buf
+}
+
+func TestSpectatorBrokenStream(t *testing.T) {
+	start := spectateMsg{Kind: SPECTATE_START, Mode: MODE_COOP, Players: 1, Seed: 5}
+	tests := []struct {
+		name string
+		msgs []spectateMsg
+	}{
+		{"unknown mode", []spectateMsg{{Kind: SPECTATE_START, Mode: 99, Players: 1}}},
+		{"no players", []spectateMsg{{Kind: SPECTATE_START, Mode: MODE_COOP, Players: -1}}},
+		{"too many players", []spectateMsg{{Kind: SPECTATE_START, Mode: MODE_COOP, Players: 1 << 40}}},
+		{"short input row", []spectateMsg{start, {Kind: SPECTATE_INPUT, Inputs: [][]uint64{{}}}}},
+		{"long input row", []spectateMsg{start, {Kind: SPECTATE_INPUT, Inputs: [][]uint64{{0, 0, 0}}}}},
+		{"too many worlds", []spectateMsg{start, {Kind: SPECTATE_INPUT, Inputs: [][]uint64{{0}, {0}}}}},
+		{"missing player", []spectateMsg{{Kind: SPECTATE_SNAPSHOT, Worlds: json.RawMessage(`[{"Players":[null]}]`)}}},
+		{"no worlds", []spectateMsg{{Kind: SPECTATE_SNAPSHOT, Worlds: json.RawMessage(`[]`)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := spectate(t, spectateStream(tt.msgs...))
+			if s.Err == nil {
+				t.Error("the stream was accepted")
+			}
+		})
+	}
+}
+
+func TestSpectatorTruncatedStream(t *testing.T) {
+	start := spectateMsg{Kind: SPECTATE_START, Mode: MODE_COOP, Players: 1, Seed: 5}
+	input := spectateMsg{Kind: SPECTATE_INPUT, Inputs: [][]uint64{{0}}}
+	stream := spectateStream(start, input)
+	s := spectate(t, stream[:len(stream)-8])
+	if s.Err != nil {
+		t.Errorf("a stream that stopped early is broken: %v", s.Err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+// Starfield describes a background of stars that is generated rather than
+// drawn, stars are spread over a number of depth layers where the nearest
+// layer scrolls at Speed and further ones scroll slower and dimmer. Twinkle
+// is how much the brightness of the stars flickers, from 0 to 1. The stars
+// are placed from Seed, or from the seed of the game being played when it
+// is 0, so a replay of a game shows the same sky.
+type Starfield struct {
+	Seed    int64 `json:",omitempty"`
+	Layers  int
+	Stars   int
+	Speed   float64
+	Twinkle float64 `json:",omitempty"`
+}
+
+type Star struct {
+	X, Y  float64
+	Depth float64
+	Color color.RGBA
+	Phase float64
+	Rate  float64
+}
+
+// starColors are the colors of stars from hot to cool.
+var starColors = []color.RGBA{
+	{0xa0, 0xc0, 0xff, 0xff},
+	{0xd0, 0xe0, 0xff, 0xff},
+	{0xff, 0xff, 0xff, 0xff},
+	{0xff, 0xf0, 0xc0, 0xff},
+	{0xff, 0xd0, 0x90, 0xff},
+	{0xff, 0xa0, 0x80, 0xff},
+}
+
+// starSeed returns the seed a level's starfield is generated from, every
+// level of a game gets its own sky.
+func starSeed(s *Starfield, level int) int64 {
+	seed := s.Seed
+	if seed == 0 && len(worlds) > 0 {
+		seed = worlds[0].Seed
+	}
+	return seed*31 + int64(level)
+}
+
+func genStars(s *Starfield, seed int64, w, h int) []Star {
+	layers, count := s.Layers, s.Stars
+	if layers < 1 {
+		layers = 1
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	var stars []Star
+	for l := 0; l < layers; l++ {
+		depth := float64(l+1) / float64(layers)
+		for i := 0; i < count; i++ {
+			c := starColors[r.Intn(len(starColors))]
+			v := 0.4 + 0.6*depth*(0.6+0.4*r.Float64())
+			stars = append(stars, Star{
+				X:     r.Float64() * float64(w),
+				Y:     r.Float64() * float64(h),
+				Depth: depth,
+				Color: color.RGBA{uint8(float64(c.R) * v), uint8(float64(c.G) * v), uint8(float64(c.B) * v), 0xff},
+				Phase: r.Float64() * 2 * math.Pi,
+				Rate:  0.05 + r.Float64()*0.15,
+			})
+		}
+	}
+	return stars
+}
+
+// blitStars draws the stars straight into the canvas, the nearest ones are
+// two pixels wide.
+func (p *Parallax) blitStars() {
+	b := canvas.Bounds()
+	h := float64(b.Dy())
+	for _, s := range p.stars {
+		y := math.Mod(s.Y+p.starOffset*s.Depth, h)
+		if y < 0 {
+			y += h
+		}
+		x := int(s.X)
+
+		v := 1 - p.Starfield.Twinkle*0.5*(1+math.Sin(s.Phase+float64(p.frame)*s.Rate))
+		c := color.RGBA{uint8(float64(s.Color.R) * v), uint8(float64(s.Color.G) * v), uint8(float64(s.Color.B) * v), 0xff}
+		canvas.SetRGBA(x, int(y), c)
+		if s.Depth == 1 {
+			canvas.SetRGBA(x+1, int(y), c)
+			canvas.SetRGBA(x, int(y)+1, c)
+			canvas.SetRGBA(x+1, int(y)+1, c)
+		}
+	}
+}